@@ -0,0 +1,93 @@
+// Copyright 2013 Ivan Danyliuk
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xml
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rogpeppe/go-charset/charset"
+)
+
+// isUTF8 reports whether name is the name of UTF-8 charset.
+func isUTF8(name string) bool {
+	return strings.EqualFold(name, "utf-8") || strings.EqualFold(name, "utf8")
+}
+
+// charsetWriter converts the UTF-8 encoded XML written to it into another
+// charset. Characters the charset doesn't have are written as the
+// character references instead, so no data is lost.
+type charsetWriter struct {
+	w       io.Writer
+	tr      charset.Translator
+	probe   charset.Translator
+	known   map[rune]bool
+	pending []byte
+	buf     []byte
+}
+
+// newCharsetWriter returns the writer converting to the charset name.
+func newCharsetWriter(w io.Writer, name string) (*charsetWriter, error) {
+	tr, err := charset.TranslatorTo(name)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q", name)
+	}
+	probe, _ := charset.TranslatorTo(name)
+	return &charsetWriter{w: w, tr: tr, probe: probe, known: make(map[rune]bool)}, nil
+}
+
+func (w *charsetWriter) Write(p []byte) (int, error) {
+	data := p
+	if len(w.pending) > 0 {
+		data = append(w.pending, p...)
+	}
+	w.buf = w.buf[:0]
+	i := 0
+	for i < len(data) {
+		if data[i] < utf8.RuneSelf {
+			w.buf = append(w.buf, data[i])
+			i++
+			continue
+		}
+		if !utf8.FullRune(data[i:]) {
+			// the rest of the rune comes with the next write
+			break
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		if w.encodable(r) {
+			w.buf = append(w.buf, data[i:i+size]...)
+		} else {
+			w.buf = append(w.buf, "&#"...)
+			w.buf = strconv.AppendInt(w.buf, int64(r), 10)
+			w.buf = append(w.buf, ';')
+		}
+		i += size
+	}
+	w.pending = append([]byte(nil), data[i:]...)
+
+	_, out, err := w.tr.Translate(w.buf, false)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// encodable reports whether the charset has the character r, which
+// is translated to '?' otherwise.
+func (w *charsetWriter) encodable(r rune) bool {
+	ok, found := w.known[r]
+	if !found {
+		_, out, err := w.probe.Translate([]byte(string(r)), true)
+		ok = err == nil && !(len(out) == 1 && out[0] == '?')
+		w.known[r] = ok
+	}
+	return ok
+}
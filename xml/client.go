@@ -5,22 +5,27 @@
 package xml
 
 import (
+	"bytes"
 	"io"
-	"io/ioutil"
 )
 
 // EncodeClientRequest encodes parameters for a XML-RPC client request.
 func EncodeClientRequest(method string, args interface{}) ([]byte, error) {
-	xml, err := rpcRequest2XML(method, args)
-	return []byte(xml), err
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).EncodeRequest(method, args)
+	return buf.Bytes(), err
 }
 
 // DecodeClientResponse decodes the response body of a client request into
 // the interface reply.
 func DecodeClientResponse(r io.Reader, reply interface{}) error {
-	rawxml, err := ioutil.ReadAll(r)
-	if err != nil {
-		return FaultSystemError
-	}
-	return xml2RPC(string(rawxml), reply)
+	return NewDecoder(r).DecodeResponse(reply)
+}
+
+// DecodeClientResponseWithOptions is like DecodeClientResponse,
+// but decodes the response using opts.
+func DecodeClientResponseWithOptions(r io.Reader, reply interface{}, opts DecoderOptions) error {
+	decoder := NewDecoder(r)
+	decoder.SetOptions(opts)
+	return decoder.DecodeResponse(reply)
 }
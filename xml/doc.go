@@ -15,9 +15,9 @@ Implementation details
 
 The main objective was to use standard encoding/xml package for XML marshalling/unmarshalling. Unfortunately, in current implementation there is no graceful way to implement common structre for marshal and unmarshal functions - marshalling doesn't handle interface{} types so far (though, it could be changed in the future). So, marshalling is implemented manually.
 
-Unmarshalling code first creates temporary structure for unmarshalling XML into, then converts it into the passed variable using reflect package. If XML struct member's name is lowercased, it's first letter will be uppercased, as in Go/Gorilla field name must be exported(first-letter uppercased).
+Unmarshalling code (Decoder) reads XML tokens from the io.Reader and stores the values directly into the passed variable using reflect package, without keeping the document in memory. Struct members are matched to the fields by the tag or field name, falling back to the case-insensitive match, so lowercased members fill the exported fields (see also DecoderOptions.SnakeCase).
 
-Marshalling code converts rpc directly to the string XML representation.
+Marshalling code (Encoder) writes rpc directly to the io.Writer as the XML representation, without building it in memory.
 
 For the better understanding, I use terms 'rpc2xml' and 'xml2rpc' instead of 'marshal' and 'unmarshall'.
 
@@ -27,15 +27,104 @@ The following types are supported:
 
     XML-RPC             Golang
     -------             ------
-    int, i4             int
-    double              float64
+    int, i4             int, int8-int64, uint-uint64
+    i8 (extension)      int64, uint64 (see EncoderOptions.I8)
+    double              float64, float32
     boolean             bool
     stringi             string
     dateTime.iso8601    time.Time
     base64              []byte
-    struct              struct
-    array               []interface{}
-    nil                 nil
+    struct              struct, map[string]T
+    array               []T, [N]T (exactly N items), []interface{}
+    nil                 nil, nil pointer
+
+Pointers are dereferenced on encoding and allocated on decoding, so optional
+parameters and struct members can be declared as *T.
+
+Struct fields are mapped to struct members by name. The name can be changed with
+the `xmlrpc` struct tag (the `xml` tag is used, if there is no `xmlrpc` one), which
+also accepts the "omitempty" option. Fields tagged with "-" and unexported fields
+are ignored:
+
+    type Post struct {
+        ID    int    `xmlrpc:"post_id"`
+        Title string `xmlrpc:"title,omitempty"`
+        Cache string `xmlrpc:"-"`
+    }
+
+Trailing params can be made optional with the "optional" option, or with
+"default=value", which also sets the value of the param, when it's missing
+from the request. The default is converted as the string value and can't
+contain commas. It's converted once, when the type is first decoded, and the
+invalid default fails every request with FaultInternalError:
+
+    type SearchArgs struct {
+        Query string
+        Limit int    `xmlrpc:",default=10"`
+        Sort  string `xmlrpc:",optional"`
+    }
+
+The last params field tagged with "rest" collects all the remaining params
+into the slice, e.g. []interface{}, and is expanded into the separate params
+on encoding:
+
+    type LogArgs struct {
+        Level string
+        Args  []interface{} `xmlrpc:",rest"`
+    }
+
+Fields of embedded structs are promoted to the parent struct members, following
+the encoding/json rules, unless the embedded struct is given a name in the tag.
+
+Single values can be converted to and from the <value> element with Marshal
+and Unmarshal, e.g. for storage or testing. Fields of the RawValue type keep
+the <value> element as is, to be decoded later with Unmarshal, e.g. once
+the type of the payload is known from another param, and are written back
+unchanged. Unmarshal is strict: data after the <value> element, or after the
+type element of any value, is rejected as corrupted.
+
+Types can control their own representation by implementing the Marshaler and
+Unmarshaler interfaces. Types implementing encoding.TextMarshaler and
+encoding.TextUnmarshaler (uuid, net.IP, decimals) are encoded as and decoded
+from string.
+
+dateTime.iso8601 values are written without the zone, in the location of the
+time.Time, unless EncoderOptions.Location or EncoderOptions.TimeZone is set.
+Decoding accepts dashed dates, fractional seconds and "Z" or "+hh:mm" zones;
+values without the zone are interpreted in time.Local.
+
+Requests and responses in the charsets other than UTF-8 are decoded, if the
+charset is declared in the XML header. Responses are written in UTF-8, unless
+EncoderOptions.Charset is set with Codec.SetEncoderOptions, e.g. to
+"ISO-8859-1" for old clients, which is declared in the XML header and
+Content-Type. Characters the charset doesn't have are written as the
+character references.
+
+Values decoded into interface{} get the natural Go type from the table above:
+int (int64 for i8), float64, string, bool, time.Time, []byte, []interface{}
+for arrays, map[string]interface{} for structs and nil.
+
+Empty values keep their type: <string/> and <base64/> decode to "" and empty
+[]byte, empty arrays to empty non-nil slices and empty structs to non-nil maps.
+The empty <value/> is the empty string, and leaves non-string fields untouched.
+
+Values of the mismatching types are rejected, unless DecoderOptions.Coerce is
+set with Codec.SetDecoderOptions, Decoder.SetOptions or
+DecodeClientResponseWithOptions. It allows <int> into float fields, if the
+float type holds the integer exactly, and strings holding numbers or booleans
+into numeric and bool fields.
+
+Struct members not matching any field are ignored, unless
+DecoderOptions.DisallowUnknownMembers is set, which rejects them with the
+fault naming the member.
+
+Errors returned by the service methods are sent as faults: Fault as is, other
+errors as FaultApplicationError. Members of Fault.Detail are written along
+with faultCode and faultString, and the extra members of the received faults
+are kept there. The faultCode is accepted as any integer or numeric string.
+Faults are comparable, and errors.Is also matches the faults which string is
+extended with the message, e.g. errors.Is(err, xml.FaultInvalidParams) holds
+for "Invalid Method Parameters: ..." faults.
 
 TODO
 
@@ -6,6 +6,8 @@ package xml
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 // Default Faults
@@ -21,32 +23,73 @@ var (
 )
 
 // Fault represents XML-RPC Fault.
+//
+// Detail holds the fault struct members other than faultCode and
+// faultString, which are sent by some servers, and is written along
+// with them by the server. It's the pointer, so Fault stays comparable.
 type Fault struct {
-	Code   int    `xml:"faultCode"`
-	String string `xml:"faultString"`
+	Code   int          `xml:"faultCode"`
+	String string       `xml:"faultString"`
+	Detail *FaultDetail `xml:"-"`
 }
 
+// FaultDetail maps the extra fault struct members to their values.
+type FaultDetail map[string]interface{}
+
 // Error satisifies error interface for Fault.
 func (f Fault) Error() string {
 	return fmt.Sprintf("%d: %s", f.Code, f.String)
 }
 
-// Fault2XML is a quick 'marshalling' replacemnt for the Fault case.
-func fault2XML(fault Fault) string {
-	buffer := "<methodResponse><fault>"
-	xml, _ := rpc2XML(fault)
-	buffer += xml
-	buffer += "</fault></methodResponse>"
-	return buffer
+// Is reports whether target is the Fault with the same code and string,
+// regardless of Detail. The string may also be extended with the message,
+// e.g. "Invalid Method Parameters: ..." matches FaultInvalidParams.
+func (f Fault) Is(target error) bool {
+	t, ok := target.(Fault)
+	if !ok || t.Code != f.Code || !strings.HasPrefix(f.String, t.String) {
+		return false
+	}
+	rest := f.String[len(t.String):]
+	return rest == "" || strings.HasPrefix(rest, ": ")
 }
 
-type faultValue struct {
-	Value value `xml:"value"`
+// members2Fault builds the Fault from the fault struct members. The code
+// is accepted as any integer, integral double or numeric string. If it
+// can't be converted, it's kept in Detail.
+func members2Fault(members map[string]interface{}) Fault {
+	var fault Fault
+	for name, v := range members {
+		switch name {
+		case "faultCode":
+			if code, ok := faultCode(v); ok {
+				fault.Code = code
+				continue
+			}
+		case "faultString":
+			if v != nil {
+				fault.String = fmt.Sprint(v)
+			}
+			continue
+		}
+		if fault.Detail == nil {
+			fault.Detail = &FaultDetail{}
+		}
+		(*fault.Detail)[name] = v
+	}
+	return fault
 }
 
-// IsEmpty returns true if faultValue contain fault.
-//
-// faultValue should be a struct with 2 members.
-func (f faultValue) IsEmpty() bool {
-	return len(f.Value.Struct) == 0
+func faultCode(v interface{}) (int, bool) {
+	switch code := v.(type) {
+	case int:
+		return code, true
+	case int64:
+		return int(code), int64(int(code)) == code
+	case float64:
+		return int(code), float64(int(code)) == code
+	case string:
+		i, err := strconv.Atoi(strings.TrimSpace(code))
+		return i, err == nil
+	}
+	return 0, false
 }
@@ -5,7 +5,10 @@
 package xml
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -61,7 +64,7 @@ func TestFaults(t *testing.T) {
 	if fault.Code != -32602 {
 		t.Errorf("wrong fault code: %d", fault.Code)
 	}
-	if fault.String != "Wrong Arguments Number" {
+	if fault.String != "Wrong Arguments Number: expected 2 params, got 3" {
 		t.Errorf("wrong fault string: %s", fault.String)
 	}
 
@@ -82,3 +85,111 @@ func TestFaults(t *testing.T) {
 		t.Errorf("wrong response: %s", fault.String)
 	}
 }
+
+type FaultTestChanResponse struct {
+	Result chan int
+}
+
+func (t *FaultTest) Chan(r *http.Request, req *FaultTestRequest, res *FaultTestChanResponse) error {
+	res.Result = make(chan int)
+	return nil
+}
+
+func TestFaultEncodingError(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(FaultTest), "")
+
+	var res FaultTestResponse
+	err := execute(t, s, "FaultTest.Chan", &FaultTestRequest{4, 2}, &res)
+	fault, ok := err.(Fault)
+	if !ok {
+		t.Fatal("expected error to be of concrete type Fault, but got", err)
+	}
+	if fault.Code != FaultInternalError.Code {
+		t.Errorf("wrong fault code: %d", fault.Code)
+	}
+	if fault.String != "Internal Server Error: Result: unsupported type chan int" {
+		t.Errorf("wrong fault string: %s", fault.String)
+	}
+}
+
+func (t *FaultTest) Divide(r *http.Request, req *FaultTestRequest, res *FaultTestResponse) error {
+	if req.B == 0 {
+		return Fault{Code: 3, String: "Division by zero", Detail: &FaultDetail{"dividend": req.A}}
+	}
+	res.Result = req.A / req.B
+	return nil
+}
+
+func (t *FaultTest) Fail(r *http.Request, req *FaultTestRequest, res *FaultTestResponse) error {
+	return errors.New("something went wrong")
+}
+
+func TestFaultDetail(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "text/xml")
+	s.RegisterService(new(FaultTest), "")
+
+	var res FaultTestResponse
+	err := execute(t, s, "FaultTest.Divide", &FaultTestRequest{4, 0}, &res)
+	expected := Fault{Code: 3, String: "Division by zero", Detail: &FaultDetail{"dividend": 4}}
+	if !reflect.DeepEqual(err, expected) {
+		t.Error("Expected", expected)
+		t.Error("Got", err)
+	}
+
+	err = execute(t, s, "FaultTest.Fail", &FaultTestRequest{4, 2}, &res)
+	expected = Fault{Code: -32500, String: "Application Error: something went wrong"}
+	if err != expected {
+		t.Error("Expected", expected)
+		t.Error("Got", err)
+	}
+	if !errors.Is(err, FaultApplicationError) {
+		t.Error("expected errors.Is to match", FaultApplicationError)
+	}
+}
+
+func TestFaultIs(t *testing.T) {
+	tests := []struct {
+		err    error
+		target Fault
+		is     bool
+	}{
+		{FaultDecode, FaultDecode, true},
+		{Fault{Code: -32602, String: "Invalid Method Parameters: integer 300 overflows uint8"}, FaultInvalidParams, true},
+		{Fault{Code: 3, String: "Division by zero", Detail: &FaultDetail{"dividend": 4}}, Fault{Code: 3, String: "Division by zero"}, true},
+		{fmt.Errorf("call failed: %w", FaultSystemError), FaultSystemError, true},
+		{Fault{Code: -32602, String: "Wrong Arguments Number"}, FaultInvalidParams, false},
+		{Fault{Code: -32602, String: "Invalid Method Parameters2"}, FaultInvalidParams, false},
+		{Fault{Code: -32603, String: "Invalid Method Parameters"}, FaultInvalidParams, false},
+	}
+	for _, tt := range tests {
+		if errors.Is(tt.err, tt.target) != tt.is {
+			t.Errorf("errors.Is(%v, %v) != %v", tt.err, tt.target, tt.is)
+		}
+	}
+}
+
+func TestFaultDecoding(t *testing.T) {
+	tests := []struct {
+		members  string
+		expected Fault
+	}{
+		{"<member><name>faultCode</name><value><int>4</int></value></member><member><name>faultString</name><value><string>Too many parameters.</string></value></member>", Fault{Code: 4, String: "Too many parameters."}},
+		{"<member><name>faultString</name><value>Too many parameters.</value></member><member><name>faultCode</name><value><i4>4</i4></value></member>", Fault{Code: 4, String: "Too many parameters."}},
+		{"<member><name>faultCode</name><value><string>4</string></value></member><member><name>faultString</name><value><string>Too many parameters.</string></value></member>", Fault{Code: 4, String: "Too many parameters."}},
+		{"<member><name>faultCode</name><value> 4 </value></member><member><name>faultString</name><value><string>Too many parameters.</string></value></member>", Fault{Code: 4, String: "Too many parameters."}},
+		{"<member><name>faultCode</name><value><i8>-32601</i8></value></member><member><name>faultString</name><value><string>Method not found</string></value></member>", Fault{Code: -32601, String: "Method not found"}},
+		{"<member><name>faultCode</name><value><int>1</int></value></member><member><name>faultString</name><value><string>&lt;class 'Exception'&gt;:boom</string></value></member><member><name>faultCause</name><value><struct><member><name>line</name><value><int>7</int></value></member></struct></value></member>", Fault{Code: 1, String: "<class 'Exception'>:boom", Detail: &FaultDetail{"faultCause": map[string]interface{}{"line": 7}}}},
+		{"<member><name>faultCode</name><value><string>Server.Unavailable</string></value></member><member><name>faultString</name><value><string>Try later</string></value></member>", Fault{String: "Try later", Detail: &FaultDetail{"faultCode": "Server.Unavailable"}}},
+	}
+	for _, tt := range tests {
+		data := "<methodResponse><fault><value><struct>" + tt.members + "</struct></value></fault></methodResponse>"
+		err := DecodeClientResponse(strings.NewReader(data), new(FaultTestResponse))
+		if !reflect.DeepEqual(err, tt.expected) {
+			t.Error("Expected", tt.expected)
+			t.Error("Got", err)
+		}
+	}
+}
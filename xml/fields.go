@@ -0,0 +1,360 @@
+// Copyright 2013 Ivan Danyliuk
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xml
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fieldInfo describes the struct field mapped to the XML-RPC struct member.
+type fieldInfo struct {
+	name      string
+	index     []int
+	typ       reflect.Type
+	tagged    bool
+	omitEmpty bool
+
+	// optional params may be missing from the request, in which case
+	// def, if set, is stored into the field.
+	optional   bool
+	def        string
+	hasDefault bool
+
+	// rest is the last params field, which is the slice holding
+	// all the remaining params.
+	rest bool
+}
+
+// structFields is the list of struct fields with the indexes by name,
+// by the lowercased name and by the lowercased name without underscores.
+type structFields struct {
+	list         []fieldInfo
+	byName       map[string]int
+	byFoldedName map[string]int
+	bySnakeName  map[string]int
+}
+
+// fieldCache maps reflect.Type to its *structFields.
+var fieldCache sync.Map
+
+// cachedTypeFields is like typeFields, but uses the cache to avoid
+// the repeated work for the same type.
+func cachedTypeFields(t reflect.Type) *structFields {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(*structFields)
+	}
+	fields := typeFields(t)
+	sf := &structFields{
+		list:         fields,
+		byName:       make(map[string]int, len(fields)),
+		byFoldedName: make(map[string]int, len(fields)),
+		bySnakeName:  make(map[string]int, len(fields)),
+	}
+	for i, f := range fields {
+		sf.byName[f.name] = i
+		// The first field wins, if several differ only in case.
+		if _, ok := sf.byFoldedName[foldName(f.name)]; !ok {
+			sf.byFoldedName[foldName(f.name)] = i
+		}
+		if _, ok := sf.bySnakeName[snakeName(f.name)]; !ok {
+			sf.bySnakeName[snakeName(f.name)] = i
+		}
+	}
+	f, _ := fieldCache.LoadOrStore(t, sf)
+	return f.(*structFields)
+}
+
+// typeFields returns the list of fields of the struct type t, which are
+// encoded and decoded as struct members.
+//
+// Member name is taken from the `xmlrpc` tag, or from the `xml` tag if
+// there is no `xmlrpc` one, and defaults to the field name. Fields tagged
+// with "-" and unexported fields are skipped.
+//
+// Fields of the embedded structs without a name in the tag are promoted
+// to the parent, following the encoding/json rules: the shallowest field
+// wins, then the tagged one, and the fields conflicting on the same level
+// are dropped.
+func typeFields(t reflect.Type) []fieldInfo {
+	var (
+		current []fieldInfo
+		next    = []fieldInfo{{typ: t}}
+
+		count     map[reflect.Type]int
+		nextCount = map[reflect.Type]int{}
+
+		visited = map[reflect.Type]bool{}
+		fields  []fieldInfo
+	)
+
+	for len(next) > 0 {
+		current, next = next, current[:0]
+		count, nextCount = nextCount, map[reflect.Type]int{}
+
+		for _, f := range current {
+			if visited[f.typ] {
+				continue
+			}
+			visited[f.typ] = true
+
+			for i := 0; i < f.typ.NumField(); i++ {
+				sf := f.typ.Field(i)
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous {
+					// Unexported embedded structs still
+					// promote their exported fields.
+					if sf.PkgPath != "" && ft.Kind() != reflect.Struct {
+						continue
+					}
+				} else if sf.PkgPath != "" {
+					continue
+				}
+
+				tag, ok := sf.Tag.Lookup("xmlrpc")
+				if !ok {
+					tag = sf.Tag.Get("xml")
+				}
+				if tag == "-" {
+					continue
+				}
+				name, opts := parseTag(tag)
+
+				index := make([]int, len(f.index)+1)
+				copy(index, f.index)
+				index[len(f.index)] = i
+
+				if name != "" || !sf.Anonymous || ft.Kind() != reflect.Struct || ft == timeType {
+					def, hasDefault := opts.value("default")
+					fields = append(fields, fieldInfo{
+						name:       name,
+						index:      index,
+						typ:        sf.Type,
+						tagged:     name != "",
+						omitEmpty:  opts.contains("omitempty"),
+						optional:   hasDefault || opts.contains("optional"),
+						def:        def,
+						hasDefault: hasDefault,
+						rest:       opts.contains("rest"),
+					})
+					if fields[len(fields)-1].name == "" {
+						fields[len(fields)-1].name = sf.Name
+					}
+					if count[f.typ] > 1 {
+						// The struct is embedded several times on
+						// this level, so add the duplicate to have
+						// its fields annihilated below.
+						fields = append(fields, fields[len(fields)-1])
+					}
+					continue
+				}
+
+				nextCount[ft]++
+				if nextCount[ft] == 1 {
+					next = append(next, fieldInfo{name: ft.Name(), index: index, typ: ft})
+				}
+			}
+		}
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		x := fields
+		if x[i].name != x[j].name {
+			return x[i].name < x[j].name
+		}
+		if len(x[i].index) != len(x[j].index) {
+			return len(x[i].index) < len(x[j].index)
+		}
+		if x[i].tagged != x[j].tagged {
+			return x[i].tagged
+		}
+		return indexLess(x[i].index, x[j].index)
+	})
+
+	// Keep only the dominant field for every name.
+	out := fields[:0]
+	for advance, i := 0, 0; i < len(fields); i += advance {
+		name := fields[i].name
+		for advance = 1; i+advance < len(fields); advance++ {
+			if fields[i+advance].name != name {
+				break
+			}
+		}
+		if dominant, ok := dominantField(fields[i : i+advance]); ok {
+			out = append(out, dominant)
+		}
+	}
+	fields = out
+
+	sort.Slice(fields, func(i, j int) bool {
+		return indexLess(fields[i].index, fields[j].index)
+	})
+	return fields
+}
+
+// byMember returns the index in list of the field for the struct member
+// name. The exact match on the tag or field name wins, then the
+// case-insensitive one. If snake is set, the names are also compared
+// ignoring underscores, so "blog_id" matches the BlogID field.
+func (sf *structFields) byMember(name string, snake bool) (int, bool) {
+	i, ok := sf.byName[name]
+	if !ok {
+		i, ok = sf.byFoldedName[foldName(name)]
+	}
+	if !ok && snake {
+		i, ok = sf.bySnakeName[snakeName(name)]
+	}
+	return i, ok
+}
+
+func foldName(name string) string {
+	return strings.ToLower(name)
+}
+
+func snakeName(name string) string {
+	return strings.Replace(strings.ToLower(name), "_", "", -1)
+}
+
+// splitRest splits the params fields into the fixed ones and the rest
+// field, if there is one. The rest field must be the last one and
+// a slice.
+func splitRest(fields []fieldInfo) ([]fieldInfo, *fieldInfo, error) {
+	for i := range fields {
+		if !fields[i].rest {
+			continue
+		}
+		if i != len(fields)-1 || fields[i].typ.Kind() != reflect.Slice {
+			return nil, nil, fmt.Errorf("rest field %s must be the last field and a slice", fields[i].name)
+		}
+		return fields[:i], &fields[i], nil
+	}
+	return fields, nil, nil
+}
+
+// dominantField returns the field winning among the fields with the same
+// name, which are sorted by depth and tagging. There is no winner, if
+// several fields share the top depth and tagging.
+func dominantField(fields []fieldInfo) (fieldInfo, bool) {
+	if len(fields) > 1 && len(fields[0].index) == len(fields[1].index) && fields[0].tagged == fields[1].tagged {
+		return fieldInfo{}, false
+	}
+	return fields[0], true
+}
+
+func indexLess(a, b []int) bool {
+	for k, x := range a {
+		if k >= len(b) {
+			return false
+		}
+		if x != b[k] {
+			return x < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// fieldByIndex returns the field of the struct v by its index. It returns
+// false if the field is promoted through the nil embedded pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// fieldByIndexAlloc is like fieldByIndex, but allocates the nil embedded
+// pointers on the way. It returns the invalid value, if the pointer
+// can't be set.
+func fieldByIndexAlloc(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// tagOptions is the comma-separated list of options following
+// the name in the struct tag.
+type tagOptions string
+
+// parseTag splits the struct tag into its name and options.
+func parseTag(tag string) (string, tagOptions) {
+	if i := strings.Index(tag, ","); i != -1 {
+		return tag[:i], tagOptions(tag[i+1:])
+	}
+	return tag, ""
+}
+
+// contains reports whether the option list contains name.
+func (o tagOptions) contains(name string) bool {
+	s := string(o)
+	for s != "" {
+		var next string
+		if i := strings.Index(s, ","); i >= 0 {
+			s, next = s[:i], s[i+1:]
+		}
+		if s == name {
+			return true
+		}
+		s = next
+	}
+	return false
+}
+
+// value returns the value of the "name=value" option.
+func (o tagOptions) value(name string) (string, bool) {
+	s := string(o)
+	for s != "" {
+		var next string
+		if i := strings.Index(s, ","); i >= 0 {
+			s, next = s[:i], s[i+1:]
+		}
+		if strings.HasPrefix(s, name+"=") {
+			return s[len(name)+1:], true
+		}
+		s = next
+	}
+	return "", false
+}
+
+// isEmptyValue reports whether v is empty in the sense of omitempty,
+// as in encoding/json.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+// Copyright 2013 Ivan Danyliuk
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xml
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// Marshal returns the XML-RPC <value> element for v.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).EncodeValue(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal parses the XML-RPC <value> element and stores the result
+// in the value pointed to by v. Unlike the Decoder, it rejects anything
+// but whitespace after the element, and after the type element of each
+// value, as the corrupted data.
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("Unmarshal requires non-nil pointer, got %T", v)
+	}
+	d := NewDecoder(bytes.NewReader(data))
+	d.strict = true
+	if err := d.DecodeValue(v); err != nil {
+		return err
+	}
+	return d.end()
+}
+
+// Marshaler is the interface implemented by types that can encode
+// themselves into XML-RPC.
+//
+// MarshalXMLRPC returns the complete <value> element, which is written
+// to the output as is.
+//
+// Types implementing encoding.TextMarshaler instead are encoded as
+// <string>, and types implementing encoding.TextUnmarshaler are
+// decoded from <string>.
+type Marshaler interface {
+	MarshalXMLRPC() ([]byte, error)
+}
+
+// Unmarshaler is the interface implemented by types that can decode
+// XML-RPC representation of themselves.
+//
+// UnmarshalXMLRPC receives the complete <value> element. It must copy
+// the data, if it needs to keep it after returning.
+type Unmarshaler interface {
+	UnmarshalXMLRPC(data []byte) error
+}
+
+// RawValue is the raw encoded XML-RPC <value> element. It can be used
+// to delay decoding of the value until its type is known, to be decoded
+// later with Unmarshal, or to write the precomputed value.
+//
+// The decoded RawValue keeps the value element as it was read, unless the
+// document is in the charset other than UTF-8. The encoder writes it as
+// is, and the nil RawValue as <nil/>.
+type RawValue []byte
+
+// MarshalXMLRPC returns r as the encoding of r.
+func (r RawValue) MarshalXMLRPC() ([]byte, error) {
+	if r == nil {
+		return []byte("<value><nil/></value>"), nil
+	}
+	return r, nil
+}
+
+// UnmarshalXMLRPC sets *r to the copy of data.
+func (r *RawValue) UnmarshalXMLRPC(data []byte) error {
+	if r == nil {
+		return errors.New("xml.RawValue: UnmarshalXMLRPC on nil pointer")
+	}
+	*r = append((*r)[0:0], data...)
+	return nil
+}
+
+var (
+	marshalerType       = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType     = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// checkValue verifies that data is the single well-formed <value> element.
+func checkValue(data []byte) error {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var depth, roots int
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				if roots++; roots > 1 || t.Name.Local != "value" {
+					return errors.New("not a single <value> element")
+				}
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 && len(bytes.TrimSpace(t)) != 0 {
+				return errors.New("text outside of <value> element")
+			}
+		}
+	}
+	if roots == 0 {
+		return errors.New("no <value> element")
+	}
+	return nil
+}
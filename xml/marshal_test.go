@@ -0,0 +1,158 @@
+// Copyright 2013 Ivan Danyliuk
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xml
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{42, "<value><int>42</int></value>"},
+		{"a < b", "<value><string>a &lt; b</string></value>"},
+		{nil, "<value><nil/></value>"},
+		{[]interface{}{1, "two"}, "<value><array><data><value><int>1</int></value><value><string>two</string></value></data></array></value>"},
+		{SubStructXml2Rpc{42, "I'm Bar", nil}, "<value><struct><member><name>Foo</name><value><int>42</int></value></member><member><name>Bar</name><value><string>I'm Bar</string></value></member><member><name>Data</name><value><array><data></data></array></value></member></struct></value>"},
+	}
+	for _, tt := range tests {
+		data, err := Marshal(tt.value)
+		if err != nil {
+			t.Errorf("Marshal(%v) failed: %v", tt.value, err)
+			continue
+		}
+		if string(data) != tt.expected {
+			t.Error("Marshal conversion failed")
+			t.Error("Expected", tt.expected)
+			t.Error("Got", string(data))
+		}
+	}
+
+	_, err := Marshal(make(chan int))
+	if _, ok := err.(*EncodeError); !ok {
+		t.Errorf("expected *EncodeError, but got %#v", err)
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	var sub SubStructXml2Rpc
+	err := Unmarshal([]byte("<value><struct><member><name>Foo</name><value><int>42</int></value></member><member><name>Data</name><value><array><data><value><int>1</int></value></data></array></value></member></struct></value>"), &sub)
+	if err != nil {
+		t.Error("Unmarshal failed", err)
+	}
+	expected := SubStructXml2Rpc{Foo: 42, Data: []int{1}}
+	if !reflect.DeepEqual(sub, expected) {
+		t.Error("Unmarshal conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", sub)
+	}
+
+	var iface interface{}
+	if err := Unmarshal([]byte(`<?xml version="1.0"?><value><string>hello</string></value>`), &iface); err != nil {
+		t.Error("Unmarshal failed", err)
+	}
+	if iface != "hello" {
+		t.Errorf("expected hello, but got %v", iface)
+	}
+
+	if err := Unmarshal([]byte("<param><value><int>1</int></value></param>"), &iface); err == nil {
+		t.Error("expected error for non-value element, but got nil")
+	}
+	if err := Unmarshal([]byte("<value><int>1</int></value>"), iface); err == nil {
+		t.Error("expected error for non-pointer, but got nil")
+	}
+
+	if err := Unmarshal([]byte("<value>\n <int>1</int>\n</value>\n<!-- end -->\n"), &iface); err != nil {
+		t.Error("Unmarshal failed", err)
+	}
+	tests := []struct {
+		data     string
+		expected error
+	}{
+		{"<value><int>1</int></value><junk>", FaultDecode},
+		{"<value><int>1</int></value>junk", FaultDecode},
+		{"<value><int>1</int></value><value><int>2</int></value>", FaultDecode},
+		{"<value><string>a</string><string>b</string></value>", Fault{Code: -32602, String: "Invalid Method Parameters: unexpected <string> after the value type"}},
+		{"<value><int>1</int>2</value>", Fault{Code: -32602, String: "Invalid Method Parameters: unexpected text \"2\" after the value type"}},
+		{"<value><array><data><value><int>1</int><int>2</int></value></data></array></value>", Fault{Code: -32602, String: "Invalid Method Parameters: unexpected <int> after the value type (array item 0)"}},
+	}
+	for _, tt := range tests {
+		if err := Unmarshal([]byte(tt.data), &iface); err != tt.expected {
+			t.Errorf("Unmarshal %s: expected %v, got %v", tt.data, tt.expected, err)
+		}
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	in := map[string]interface{}{"id": 7, "tags": []interface{}{"a", "b"}, "ratio": 0.5}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal("Marshal failed", err)
+	}
+	var out map[string]interface{}
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal("Unmarshal failed", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch: %v != %v", in, out)
+	}
+}
+
+type StructRawValue struct {
+	Kind    string
+	Payload RawValue
+}
+
+func TestRawValue(t *testing.T) {
+	payload := "<value>\n  <struct><!-- point -->\n    <member><name>X</name><value><i4>1</i4></value></member>\n    <member><name>Label</name><value>a &quot;b&quot;</value></member>\n  </struct>\n</value>"
+	data := "<methodResponse><params><param><value>point</value></param><param>" + payload + "</param></params></methodResponse>"
+	res := new(StructRawValue)
+	if err := xml2RPC(data, res); err != nil {
+		t.Fatal("XML2RPC conversion failed", err)
+	}
+	if res.Kind != "point" || string(res.Payload) != payload {
+		t.Errorf("expected raw payload %q, but got %q", payload, res.Payload)
+	}
+
+	var point struct {
+		X     int
+		Label string
+	}
+	if err := Unmarshal(res.Payload, &point); err != nil {
+		t.Fatal("Unmarshal failed", err)
+	}
+	if point.X != 1 || point.Label != "a \"b\"" {
+		t.Errorf("expected {1 a \"b\"}, but got %v", point)
+	}
+
+	resp, err := rpcResponse2XML(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "<methodResponse><params><param><value><string>point</string></value></param><param>" + payload + "</param></params></methodResponse>"
+	if resp != expected {
+		t.Error("Expected", expected)
+		t.Error("Got", resp)
+	}
+
+	if err := xml2RPC("<methodResponse><params><param><value/></param><param><value/></param></params></methodResponse>", res); err != nil {
+		t.Fatal("XML2RPC conversion failed", err)
+	}
+	if string(res.Payload) != "<value/>" {
+		t.Errorf("expected <value/>, but got %q", res.Payload)
+	}
+
+	resp, err = rpcResponse2XML(&StructRawValue{Kind: "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "<methodResponse><params><param><value><string>none</string></value></param><param><value><nil/></value></param></params></methodResponse>"; resp != expected {
+		t.Error("Expected", expected)
+		t.Error("Got", resp)
+	}
+}
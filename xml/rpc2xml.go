@@ -5,143 +5,809 @@
 package xml
 
 import (
+	"bufio"
+	"bytes"
+	"encoding"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"math"
 	"reflect"
-	"strings"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// Encoder writes XML-RPC method calls and responses to an output stream.
+//
+// The XML is written as the value is traversed, so large arrays and base64
+// blobs are never held in memory as a whole.
+type Encoder struct {
+	w    *bufio.Writer
+	out  io.Writer
+	cw   *charsetWriter
+	opts EncoderOptions
+	err  error
+
+	depth    int
+	visiting map[visit]bool
+	scratch  [64]byte
+}
+
+// visit is the pointer, map or slice being encoded, used to detect cycles.
+type visit struct {
+	typ reflect.Type
+	ptr uintptr
+	len int
+}
+
+// defaultMaxDepth is the nesting limit used if EncoderOptions.MaxDepth or
+// DecoderOptions.MaxDepth is not set. It's deep enough for any sane data
+// and still far from overflowing the stack.
+const defaultMaxDepth = 1000
+
+// EncoderOptions controls the optional behaviour of the Encoder.
+type EncoderOptions struct {
+	// I8 allows integers that don't fit into the 32-bit <int> to be
+	// written using the <i8> extension. Without it, such values
+	// are reported as an error.
+	I8 bool
+
+	// DoublePrecision, if positive, is the number of digits written
+	// after the decimal point of <double>. By default, the shortest
+	// representation reading back into the same value is used.
+	DoublePrecision int
+
+	// Location, if set, is the time zone dateTime.iso8601 values are
+	// converted to before writing, e.g. time.UTC. By default, the time
+	// is written in its own location.
+	Location *time.Location
+
+	// TimeZone appends the zone designator ("Z" or "+hh:mm") to the
+	// dateTime.iso8601 values. The spec doesn't define it, so not all
+	// implementations accept it.
+	TimeZone bool
+
+	// MaxDepth is the maximum nesting of values, which is 1000 by
+	// default. Deeper values are reported as an error. The decoder
+	// with the same DecoderOptions.MaxDepth accepts all the output.
+	MaxDepth int
+
+	// Charset, if set, is the charset the requests and responses are
+	// written in, e.g. "ISO-8859-1", which is declared in the XML header.
+	// Characters the charset doesn't have are written as the character
+	// references. By default, the output is UTF-8 with no XML header.
+	Charset string
+}
+
+// EncodeError is returned by the Encoder for the value,
+// which can't be encoded into XML-RPC.
+type EncodeError struct {
+	// Path is the location of the value inside of the encoded params,
+	// e.g. "Sub.Data[2]".
+	Path string
+	Err  error
+}
+
+func (e *EncodeError) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return e.Path + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *EncodeError) Unwrap() error {
+	return e.Err
+}
+
+// UnsupportedTypeError is the EncodeError cause for the Go types having
+// no XML-RPC representation, like channels, functions or complex numbers.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "unsupported type " + e.Type.String()
+}
+
+// UnsupportedValueError is the EncodeError cause for the values having
+// no XML-RPC representation, like integers out of range.
+type UnsupportedValueError struct {
+	Value reflect.Value
+	Str   string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "unsupported value: " + e.Str
+}
+
+// pathError prepends the path element to the path of err,
+// wrapping it into EncodeError if needed.
+func pathError(err error, elem string) error {
+	e, ok := err.(*EncodeError)
+	if !ok {
+		return &EncodeError{Path: elem, Err: err}
+	}
+	switch {
+	case e.Path == "":
+		e.Path = elem
+	case e.Path[0] == '[':
+		e.Path = elem + e.Path
+	default:
+		e.Path = elem + "." + e.Path
+	}
+	return e
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w), out: w}
+}
+
+// SetOptions changes the options used by the encoder.
+func (e *Encoder) SetOptions(opts EncoderOptions) {
+	e.opts = opts
+	e.err = e.w.Flush()
+	if e.err != nil {
+		return
+	}
+	e.cw = nil
+	if opts.Charset == "" || isUTF8(opts.Charset) {
+		e.w.Reset(e.out)
+		return
+	}
+	cw, err := newCharsetWriter(e.out, opts.Charset)
+	if err != nil {
+		e.err = &EncodeError{Err: err}
+		return
+	}
+	e.cw = cw
+	e.w.Reset(cw)
+}
+
+// discard drops the output buffered by the failed call, so the next one
+// starts with a clean document. The part already flushed to the stream
+// can't be taken back.
+func (e *Encoder) discard() {
+	if e.cw != nil {
+		e.cw.pending = e.cw.pending[:0]
+		e.w.Reset(e.cw)
+		return
+	}
+	e.w.Reset(e.out)
+}
+
+// header writes the XML header declaring the charset, if it's set.
+func (e *Encoder) header() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.opts.Charset != "" {
+		e.w.WriteString(`<?xml version="1.0" encoding="`)
+		e.escape(e.opts.Charset)
+		e.w.WriteString(`"?>`)
+	}
+	return nil
+}
+
+// EncodeRequest writes the methodCall for method to the stream.
+//
+// args is the pointer to the structure, which fields are
+// encoded as the call parameters.
+func (e *Encoder) EncodeRequest(method string, args interface{}) error {
+	if err := e.header(); err != nil {
+		return err
+	}
+	e.w.WriteString("<methodCall><methodName>")
+	e.escape(method)
+	e.w.WriteString("</methodName>")
+	if err := e.params2XML(args); err != nil {
+		e.discard()
+		return err
+	}
+	e.w.WriteString("</methodCall>")
+	return e.w.Flush()
+}
+
+// EncodeResponse writes the methodResponse for reply to the stream.
+//
+// reply is the pointer to the structure, which fields are
+// encoded as the response parameters.
+func (e *Encoder) EncodeResponse(reply interface{}) error {
+	if err := e.header(); err != nil {
+		return err
+	}
+	e.w.WriteString("<methodResponse>")
+	if err := e.params2XML(reply); err != nil {
+		e.discard()
+		return err
+	}
+	e.w.WriteString("</methodResponse>")
+	return e.w.Flush()
+}
+
+// EncodeFault writes the methodResponse carrying fault to the stream.
+// The Detail members, sorted by name, follow faultCode and faultString.
+func (e *Encoder) EncodeFault(fault Fault) error {
+	if err := e.header(); err != nil {
+		return err
+	}
+	e.w.WriteString("<methodResponse><fault><value><struct>")
+	e.w.WriteString("<member><name>faultCode</name>")
+	if err := e.rpc2XML(reflect.ValueOf(fault.Code)); err != nil {
+		e.discard()
+		return pathError(err, "Code")
+	}
+	e.w.WriteString("</member><member><name>faultString</name>")
+	if err := e.rpc2XML(reflect.ValueOf(fault.String)); err != nil {
+		e.discard()
+		return pathError(err, "String")
+	}
+	e.w.WriteString("</member>")
+
+	var members FaultDetail
+	if fault.Detail != nil {
+		members = *fault.Detail
+	}
+	names := make([]string, 0, len(members))
+	for name := range members {
+		if name != "faultCode" && name != "faultString" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	detail := reflect.ValueOf(members)
+	for _, name := range names {
+		e.w.WriteString("<member><name>")
+		e.escape(name)
+		e.w.WriteString("</name>")
+		if err := e.rpc2XML(detail.MapIndex(reflect.ValueOf(name))); err != nil {
+			e.discard()
+			return pathError(err, "Detail["+name+"]")
+		}
+		e.w.WriteString("</member>")
+	}
+	e.w.WriteString("</struct></value></fault></methodResponse>")
+	return e.w.Flush()
+}
+
+// EncodeValue writes the single <value> element for v to the stream.
+func (e *Encoder) EncodeValue(v interface{}) error {
+	if e.err != nil {
+		return e.err
+	}
+	if v == nil {
+		e.w.WriteString("<value><nil/></value>")
+		return e.w.Flush()
+	}
+	if err := e.rpc2XML(reflect.ValueOf(v)); err != nil {
+		e.discard()
+		if _, ok := err.(*EncodeError); !ok {
+			err = &EncodeError{Err: err}
+		}
+		return err
+	}
+	return e.w.Flush()
+}
+
 func rpcRequest2XML(method string, rpc interface{}) (string, error) {
-	buffer := "<methodCall><methodName>"
-	buffer += method
-	buffer += "</methodName>"
-	params, err := rpcParams2XML(rpc)
-	buffer += params
-	buffer += "</methodCall>"
-	return buffer, err
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).EncodeRequest(method, rpc)
+	return buf.String(), err
 }
 
 func rpcResponse2XML(rpc interface{}) (string, error) {
-	buffer := "<methodResponse>"
-	params, err := rpcParams2XML(rpc)
-	buffer += params
-	buffer += "</methodResponse>"
-	return buffer, err
-}
-
-func rpcParams2XML(rpc interface{}) (string, error) {
-	var err error
-	buffer := "<params>"
-	for i := 0; i < reflect.ValueOf(rpc).Elem().NumField(); i++ {
-		var xml string
-		buffer += "<param>"
-		xml, err = rpc2XML(reflect.ValueOf(rpc).Elem().Field(i).Interface())
-		buffer += xml
-		buffer += "</param>"
-	}
-	buffer += "</params>"
-	return buffer, err
-}
-
-func rpc2XML(value interface{}) (string, error) {
-	out := "<value>"
-	switch reflect.ValueOf(value).Kind() {
-	case reflect.Int:
-		out += fmt.Sprintf("<int>%d</int>", value.(int))
-	case reflect.Float64:
-		out += fmt.Sprintf("<double>%f</double>", value.(float64))
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).EncodeResponse(rpc)
+	return buf.String(), err
+}
+
+func (e *Encoder) params2XML(rpc interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(rpc))
+	if v.Kind() != reflect.Struct {
+		return &EncodeError{Err: fmt.Errorf("params must be a struct, got %T", rpc)}
+	}
+	fields, rest, err := splitRest(cachedTypeFields(v.Type()).list)
+	if err != nil {
+		return &EncodeError{Err: err}
+	}
+	e.w.WriteString("<params>")
+	for _, f := range fields {
+		field, ok := fieldByIndex(v, f.index)
+		if !ok {
+			field = reflect.Zero(f.typ)
+		}
+		if err := e.param2XML(field); err != nil {
+			return pathError(err, f.name)
+		}
+	}
+	if rest != nil {
+		// The rest field is expanded into the separate params.
+		if field, ok := fieldByIndex(v, rest.index); ok {
+			for i := 0; i < field.Len(); i++ {
+				if err := e.param2XML(field.Index(i)); err != nil {
+					return pathError(pathError(err, "["+strconv.Itoa(i)+"]"), rest.name)
+				}
+			}
+		}
+	}
+	e.w.WriteString("</params>")
+	return nil
+}
+
+func (e *Encoder) param2XML(value reflect.Value) error {
+	e.w.WriteString("<param>")
+	if err := e.rpc2XML(value); err != nil {
+		return err
+	}
+	e.w.WriteString("</param>")
+	return nil
+}
+
+func (e *Encoder) rpc2XML(value reflect.Value) error {
+	return e.encode(value, typeEncoder(value.Type()))
+}
+
+// encode writes the <value> element for value using enc, keeping
+// track of the nesting depth.
+func (e *Encoder) encode(value reflect.Value, enc encoderFunc) error {
+	maxDepth := e.opts.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxDepth
+	}
+	if e.depth >= maxDepth {
+		return &UnsupportedValueError{value, fmt.Sprintf("exceeded maximum depth of %d", maxDepth)}
+	}
+	e.depth++
+	err := enc(e, value)
+	e.depth--
+	return err
+}
+
+// encoderFunc writes the <value> element for the value of some type.
+type encoderFunc func(e *Encoder, v reflect.Value) error
+
+// encoderCache maps reflect.Type to its encoderFunc.
+var encoderCache sync.Map
+
+// typeEncoder returns the encoderFunc for the type t, compiling it
+// on the first use.
+func typeEncoder(t reflect.Type) encoderFunc {
+	if f, ok := encoderCache.Load(t); ok {
+		return f.(encoderFunc)
+	}
+
+	// Store the indirect func first to deal with the recursive types.
+	// It waits for the real func to be compiled and calls it.
+	var (
+		wg sync.WaitGroup
+		f  encoderFunc
+	)
+	wg.Add(1)
+	fi, loaded := encoderCache.LoadOrStore(t, encoderFunc(func(e *Encoder, v reflect.Value) error {
+		wg.Wait()
+		return f(e, v)
+	}))
+	if loaded {
+		return fi.(encoderFunc)
+	}
+
+	f = newTypeEncoder(t, true)
+	wg.Done()
+	encoderCache.Store(t, f)
+	return f
+}
+
+// newTypeEncoder compiles the encoderFunc for the type t. If allowAddr
+// is set, the methods of the pointer to t are used for the addressable
+// values.
+func newTypeEncoder(t reflect.Type, allowAddr bool) encoderFunc {
+	if t != timeType {
+		if t.Implements(marshalerType) {
+			return marshalerEncoder
+		}
+		if allowAddr && t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(marshalerType) {
+			return condAddrEncoder(addrMarshalerEncoder, newTypeEncoder(t, false))
+		}
+		if t.Implements(textMarshalerType) {
+			return textMarshalerEncoder
+		}
+		if allowAddr && t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(textMarshalerType) {
+			return condAddrEncoder(addrTextMarshalerEncoder, newTypeEncoder(t, false))
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return valueEncoder((*Encoder).int2XML)
+	case reflect.Float32, reflect.Float64:
+		return valueEncoder((*Encoder).double2XML)
 	case reflect.String:
-		out += string2XML(value.(string))
+		return valueEncoder(func(e *Encoder, v reflect.Value) error {
+			e.string2XML(v.String())
+			return nil
+		})
 	case reflect.Bool:
-		out += bool2XML(value.(bool))
+		return valueEncoder(func(e *Encoder, v reflect.Value) error {
+			e.bool2XML(v.Bool())
+			return nil
+		})
 	case reflect.Struct:
-		if reflect.TypeOf(value).String() != "time.Time" {
-			out += struct2XML(value)
-		} else {
-			out += time2XML(value.(time.Time))
+		if t == timeType {
+			return valueEncoder(func(e *Encoder, v reflect.Value) error {
+				e.time2XML(v.Interface().(time.Time))
+				return nil
+			})
 		}
+		return newStructEncoder(t)
 	case reflect.Slice, reflect.Array:
-		// FIXME: is it the best way to recognize '[]byte'?
-		if reflect.TypeOf(value).String() != "[]uint8" {
-			out += array2XML(value)
-		} else {
-			out += base642XML(value.([]byte))
+		if isBytes(t) {
+			return valueEncoder(func(e *Encoder, v reflect.Value) error {
+				e.bytes2XML(v)
+				return nil
+			})
 		}
+		return newArrayEncoder(t)
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return unsupportedTypeEncoder
+		}
+		return newMapEncoder(t)
 	case reflect.Ptr:
-		if reflect.ValueOf(value).IsNil() {
-			out += "<nil/>"
+		return newPtrEncoder(t)
+	case reflect.Interface:
+		return interfaceEncoder
+	}
+	return unsupportedTypeEncoder
+}
+
+// valueEncoder returns the encoderFunc, which wraps the content
+// written by f into <value>.
+func valueEncoder(f func(e *Encoder, v reflect.Value) error) encoderFunc {
+	return func(e *Encoder, v reflect.Value) error {
+		e.w.WriteString("<value>")
+		if err := f(e, v); err != nil {
+			return err
+		}
+		e.w.WriteString("</value>")
+		return nil
+	}
+}
+
+func nilEncoder(e *Encoder, v reflect.Value) error {
+	e.w.WriteString("<value><nil/></value>")
+	return nil
+}
+
+func unsupportedTypeEncoder(e *Encoder, v reflect.Value) error {
+	return &UnsupportedTypeError{v.Type()}
+}
+
+func marshalerEncoder(e *Encoder, v reflect.Value) error {
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return nilEncoder(e, v)
+	}
+	return e.marshaler2XML(v.Interface().(Marshaler))
+}
+
+func addrMarshalerEncoder(e *Encoder, v reflect.Value) error {
+	return e.marshaler2XML(v.Addr().Interface().(Marshaler))
+}
+
+func textMarshalerEncoder(e *Encoder, v reflect.Value) error {
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return nilEncoder(e, v)
+	}
+	return e.text2XML(v.Interface().(encoding.TextMarshaler))
+}
+
+func addrTextMarshalerEncoder(e *Encoder, v reflect.Value) error {
+	return e.text2XML(v.Addr().Interface().(encoding.TextMarshaler))
+}
+
+// condAddrEncoder uses addrEnc for the addressable values
+// and elseEnc for the rest.
+func condAddrEncoder(addrEnc, elseEnc encoderFunc) encoderFunc {
+	return func(e *Encoder, v reflect.Value) error {
+		if v.CanAddr() {
+			return addrEnc(e, v)
+		}
+		return elseEnc(e, v)
+	}
+}
+
+func interfaceEncoder(e *Encoder, v reflect.Value) error {
+	if v.IsNil() {
+		return nilEncoder(e, v)
+	}
+	elem := v.Elem()
+	return typeEncoder(elem.Type())(e, elem)
+}
+
+func newPtrEncoder(t reflect.Type) encoderFunc {
+	elemEnc := typeEncoder(t.Elem())
+	return func(e *Encoder, v reflect.Value) error {
+		if v.IsNil() {
+			return nilEncoder(e, v)
+		}
+		if err := e.enter(v); err != nil {
+			return err
 		}
+		defer e.leave(v)
+		return elemEnc(e, v.Elem())
+	}
+}
+
+func newStructEncoder(t reflect.Type) encoderFunc {
+	fields := cachedTypeFields(t).list
+	encoders := make([]encoderFunc, len(fields))
+	for i, f := range fields {
+		encoders[i] = typeEncoder(f.typ)
 	}
-	out += "</value>"
-	return out, nil
+	return valueEncoder(func(e *Encoder, v reflect.Value) error {
+		return e.struct2XML(v, fields, encoders)
+	})
 }
 
-func bool2XML(value bool) string {
-	var b string
+func newArrayEncoder(t reflect.Type) encoderFunc {
+	elemEnc := typeEncoder(t.Elem())
+	return valueEncoder(func(e *Encoder, v reflect.Value) error {
+		return e.array2XML(v, elemEnc)
+	})
+}
+
+func newMapEncoder(t reflect.Type) encoderFunc {
+	elemEnc := typeEncoder(t.Elem())
+	return valueEncoder(func(e *Encoder, v reflect.Value) error {
+		return e.map2XML(v, elemEnc)
+	})
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// isBytes reports whether t is the slice or array of bytes, which is sent
+// as <base64>. As in encoding/json, the bytes implementing the marshalers
+// are sent as the array of their values instead.
+func isBytes(t reflect.Type) bool {
+	if t.Kind() != reflect.Slice && t.Kind() != reflect.Array || t.Elem().Kind() != reflect.Uint8 {
+		return false
+	}
+	p := reflect.PtrTo(t.Elem())
+	return !p.Implements(marshalerType) && !p.Implements(textMarshalerType)
+}
+
+// enter marks the pointer, map or slice v as being encoded. It fails,
+// if v is already being encoded higher up, which means a cycle.
+func (e *Encoder) enter(v reflect.Value) error {
+	key := e.visitKey(v)
+	if e.visiting[key] {
+		return &UnsupportedValueError{v, "encountered a cycle via " + v.Type().String()}
+	}
+	if e.visiting == nil {
+		e.visiting = make(map[visit]bool)
+	}
+	e.visiting[key] = true
+	return nil
+}
+
+// leave unmarks v marked by enter.
+func (e *Encoder) leave(v reflect.Value) {
+	delete(e.visiting, e.visitKey(v))
+}
+
+func (e *Encoder) visitKey(v reflect.Value) visit {
+	key := visit{typ: v.Type(), ptr: v.Pointer()}
+	if v.Kind() == reflect.Slice {
+		key.len = v.Len()
+	}
+	return key
+}
+
+// text2XML writes the text returned by the TextMarshaler as <string>.
+func (e *Encoder) text2XML(m encoding.TextMarshaler) error {
+	text, err := m.MarshalText()
+	if err != nil {
+		return &EncodeError{Err: err}
+	}
+	e.w.WriteString("<value>")
+	e.string2XML(string(text))
+	e.w.WriteString("</value>")
+	return nil
+}
+
+// marshaler2XML writes the <value> element returned by the Marshaler.
+func (e *Encoder) marshaler2XML(m Marshaler) error {
+	data, err := m.MarshalXMLRPC()
+	if err != nil {
+		return &EncodeError{Err: err}
+	}
+	if err := checkValue(data); err != nil {
+		return &EncodeError{Err: fmt.Errorf("MarshalXMLRPC returned invalid XML: %v", err)}
+	}
+	e.w.Write(data)
+	return nil
+}
+
+// int2XML writes value as <int>, falling back to the <i8>
+// extension for values out of the 32-bit range, if allowed.
+func (e *Encoder) int2XML(value reflect.Value) error {
+	var i int64
+	switch value.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := value.Uint()
+		if u > math.MaxInt64 {
+			return &UnsupportedValueError{value, fmt.Sprintf("integer %d overflows <i8>", u)}
+		}
+		i = int64(u)
+	default:
+		i = value.Int()
+	}
+	tag := "int"
+	if i < math.MinInt32 || i > math.MaxInt32 {
+		if !e.opts.I8 {
+			return &UnsupportedValueError{value, fmt.Sprintf("integer %d overflows <int>", i)}
+		}
+		tag = "i8"
+	}
+	e.w.WriteString("<")
+	e.w.WriteString(tag)
+	e.w.WriteString(">")
+	e.w.Write(strconv.AppendInt(e.scratch[:0], i, 10))
+	e.w.WriteString("</")
+	e.w.WriteString(tag)
+	e.w.WriteString(">")
+	return nil
+}
+
+// double2XML writes the float value as <double>. The spec doesn't allow
+// exponents, so the value is always written in the decimal notation.
+func (e *Encoder) double2XML(value reflect.Value) error {
+	f := value.Float()
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return &UnsupportedValueError{value, strconv.FormatFloat(f, 'g', -1, 64)}
+	}
+	prec := -1
+	if e.opts.DoublePrecision > 0 {
+		prec = e.opts.DoublePrecision
+	}
+	e.w.WriteString("<double>")
+	e.w.Write(strconv.AppendFloat(e.scratch[:0], f, 'f', prec, value.Type().Bits()))
+	e.w.WriteString("</double>")
+	return nil
+}
+
+func (e *Encoder) bool2XML(value bool) {
 	if value {
-		b = "1"
+		e.w.WriteString("<boolean>1</boolean>")
 	} else {
-		b = "0"
+		e.w.WriteString("<boolean>0</boolean>")
 	}
-	return fmt.Sprintf("<boolean>%s</boolean>", b)
 }
 
-func string2XML(value string) string {
-	value = strings.Replace(value, "&", "&amp;", -1)
-	value = strings.Replace(value, "\"", "&quot;", -1)
-	value = strings.Replace(value, "<", "&lt;", -1)
-	value = strings.Replace(value, ">", "&gt;", -1)
-	return fmt.Sprintf("<string>%s</string>", value)
+func (e *Encoder) string2XML(value string) {
+	e.w.WriteString("<string>")
+	e.escape(value)
+	e.w.WriteString("</string>")
+}
+
+// escape writes value with the XML special characters replaced
+// by entities.
+func (e *Encoder) escape(value string) {
+	last := 0
+	for i := 0; i < len(value); i++ {
+		var entity string
+		switch value[i] {
+		case '&':
+			entity = "&amp;"
+		case '"':
+			entity = "&quot;"
+		case '<':
+			entity = "&lt;"
+		case '>':
+			entity = "&gt;"
+		default:
+			continue
+		}
+		e.w.WriteString(value[last:i])
+		e.w.WriteString(entity)
+		last = i + 1
+	}
+	e.w.WriteString(value[last:])
 }
 
-func struct2XML(value interface{}) (out string) {
-	out += "<struct>"
-	for i := 0; i < reflect.TypeOf(value).NumField(); i++ {
-		field := reflect.ValueOf(value).Field(i)
-		field_type := reflect.TypeOf(value).Field(i)
-		var name string
-		if field_type.Tag.Get("xml") != "" {
-			name = field_type.Tag.Get("xml")
-		} else {
-			name = field_type.Name
+func (e *Encoder) struct2XML(value reflect.Value, fields []fieldInfo, encoders []encoderFunc) error {
+	e.w.WriteString("<struct>")
+	for i, f := range fields {
+		field, ok := fieldByIndex(value, f.index)
+		if !ok || f.omitEmpty && isEmptyValue(field) {
+			continue
+		}
+		e.w.WriteString("<member><name>")
+		e.escape(f.name)
+		e.w.WriteString("</name>")
+		if err := e.encode(field, encoders[i]); err != nil {
+			return pathError(err, f.name)
 		}
-		field_value, _ := rpc2XML(field.Interface())
-		field_name := fmt.Sprintf("<name>%s</name>", name)
-		out += fmt.Sprintf("<member>%s%s</member>", field_name, field_value)
+		e.w.WriteString("</member>")
 	}
-	out += "</struct>"
-	return
+	e.w.WriteString("</struct>")
+	return nil
 }
 
-func array2XML(value interface{}) (out string) {
-	out += "<array><data>"
-	for i := 0; i < reflect.ValueOf(value).Len(); i++ {
-		item_xml, _ := rpc2XML(reflect.ValueOf(value).Index(i).Interface())
-		out += item_xml
+// map2XML writes the map as a struct, with members sorted by key
+// to keep the output deterministic.
+func (e *Encoder) map2XML(value reflect.Value, elemEnc encoderFunc) error {
+	if err := e.enter(value); err != nil {
+		return err
+	}
+	defer e.leave(value)
+
+	keys := value.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	e.w.WriteString("<struct>")
+	for _, key := range keys {
+		e.w.WriteString("<member><name>")
+		e.escape(key.String())
+		e.w.WriteString("</name>")
+		if err := e.encode(value.MapIndex(key), elemEnc); err != nil {
+			return pathError(err, "["+key.String()+"]")
+		}
+		e.w.WriteString("</member>")
 	}
-	out += "</data></array>"
-	return
+	e.w.WriteString("</struct>")
+	return nil
 }
 
-func time2XML(t time.Time) string {
-	/*
-		// TODO: find out whether we need to deal
-		// here with TZ
-		var tz string;
-		zone, offset := t.Zone()
-		if zone == "UTC" {
-			tz = "Z"
-		} else {
-			tz = fmt.Sprintf("%03d00", offset / 3600 )
+func (e *Encoder) array2XML(value reflect.Value, elemEnc encoderFunc) error {
+	if value.Kind() == reflect.Slice && value.Len() > 0 {
+		if err := e.enter(value); err != nil {
+			return err
 		}
-	*/
-	return fmt.Sprintf("<dateTime.iso8601>%04d%02d%02dT%02d:%02d:%02d</dateTime.iso8601>",
-		t.Year(), t.Month(), t.Day(),
-		t.Hour(), t.Minute(), t.Second())
+		defer e.leave(value)
+	}
+	e.w.WriteString("<array><data>")
+	for i := 0; i < value.Len(); i++ {
+		if err := e.encode(value.Index(i), elemEnc); err != nil {
+			return pathError(err, "["+strconv.Itoa(i)+"]")
+		}
+	}
+	e.w.WriteString("</data></array>")
+	return nil
+}
+
+func (e *Encoder) time2XML(t time.Time) {
+	if e.opts.Location != nil {
+		t = t.In(e.opts.Location)
+	}
+	layout := "20060102T15:04:05"
+	if e.opts.TimeZone {
+		layout += "Z07:00"
+	}
+	e.w.WriteString("<dateTime.iso8601>")
+	e.w.Write(t.AppendFormat(e.scratch[:0], layout))
+	e.w.WriteString("</dateTime.iso8601>")
+}
+
+// bytes2XML writes the slice or array of bytes value as <base64>.
+func (e *Encoder) bytes2XML(value reflect.Value) {
+	if value.Kind() == reflect.Slice {
+		e.base642XML(value.Bytes())
+		return
+	}
+	data := make([]byte, value.Len())
+	for i := range data {
+		data[i] = byte(value.Index(i).Uint())
+	}
+	e.base642XML(data)
 }
 
-func base642XML(data []byte) string {
-	str := base64.StdEncoding.EncodeToString(data)
-	return fmt.Sprintf("<base64>%s</base64>", str)
+func (e *Encoder) base642XML(data []byte) {
+	e.w.WriteString("<base64>")
+	enc := base64.NewEncoder(base64.StdEncoding, e.w)
+	enc.Write(data)
+	enc.Close()
+	e.w.WriteString("</base64>")
 }
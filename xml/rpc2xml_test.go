@@ -5,6 +5,13 @@
 package xml
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -74,3 +81,600 @@ func TestRpc2XmlNil(t *testing.T) {
 		t.Error("Got", xml)
 	}
 }
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.EncodeRequest("Some.Method", &StructSpecialCharsRpc2Xml{"a < b"}); err != nil {
+		t.Error("Encoder request failed", err)
+	}
+	if err := enc.EncodeFault(FaultInvalidParams); err != nil {
+		t.Error("Encoder fault failed", err)
+	}
+	expected := "<methodCall><methodName>Some.Method</methodName><params><param><value><string>a &lt; b</string></value></param></params></methodCall>" +
+		"<methodResponse><fault><value><struct><member><name>faultCode</name><value><int>-32602</int></value></member><member><name>faultString</name><value><string>Invalid Method Parameters</string></value></member></struct></value></fault></methodResponse>"
+	if buf.String() != expected {
+		t.Error("Encoder output mismatch")
+		t.Error("Expected", expected)
+		t.Error("Got", buf.String())
+	}
+}
+
+type StructBase64Rpc2Xml struct {
+	Data []byte
+}
+
+func TestEncoderLargeBase64(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1<<20)
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).EncodeResponse(&StructBase64Rpc2Xml{data}); err != nil {
+		t.Fatal("Encoder response failed", err)
+	}
+	res := new(StructBase64Rpc2Xml)
+	if err := xml2RPC(buf.String(), res); err != nil {
+		t.Fatal("XML2RPC conversion failed", err)
+	}
+	if !bytes.Equal(res.Data, data) {
+		t.Error("base64 round trip mismatch")
+	}
+}
+
+type MyInt int
+
+type StructIntsRpc2Xml struct {
+	Named MyInt
+	I8    int8
+	I16   int16
+	I32   int32
+	I64   int64
+	U     uint
+	U8    uint8
+	U16   uint16
+	U32   uint32
+	U64   uint64
+}
+
+func TestRPC2XMLIntegers(t *testing.T) {
+	req := &StructIntsRpc2Xml{-1, -8, -16, -32, -64, 1, 8, 16, 32, 64}
+	xml, err := rpcResponse2XML(req)
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodResponse><params><param><value><int>-1</int></value></param><param><value><int>-8</int></value></param><param><value><int>-16</int></value></param><param><value><int>-32</int></value></param><param><value><int>-64</int></value></param><param><value><int>1</int></value></param><param><value><int>8</int></value></param><param><value><int>16</int></value></param><param><value><int>32</int></value></param><param><value><int>64</int></value></param></params></methodResponse>"
+	if xml != expected {
+		t.Error("RPC2XML integers conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+}
+
+type StructInt64Rpc2Xml struct {
+	I64 int64
+}
+
+func TestRPC2XMLIntegerOverflow(t *testing.T) {
+	req := &StructInt64Rpc2Xml{1 << 40}
+	if _, err := rpcResponse2XML(req); err == nil {
+		t.Error("expected overflow error, but got nil")
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetOptions(EncoderOptions{I8: true})
+	if err := enc.EncodeResponse(req); err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodResponse><params><param><value><i8>1099511627776</i8></value></param></params></methodResponse>"
+	if buf.String() != expected {
+		t.Error("RPC2XML i8 conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", buf.String())
+	}
+
+	if _, err := rpcResponse2XML(&StructIntsRpc2Xml{U64: 1 << 63}); err == nil {
+		t.Error("expected overflow error, but got nil")
+	}
+}
+
+type StructMapRpc2Xml struct {
+	Map  map[string]interface{}
+	Ints map[string]int
+}
+
+func TestRPC2XMLMap(t *testing.T) {
+	req := &StructMapRpc2Xml{
+		map[string]interface{}{"b": "two", "a": 1, "c": nil},
+		map[string]int{"z": 26, "y": 25},
+	}
+	xml, err := rpcResponse2XML(req)
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodResponse><params><param><value><struct><member><name>a</name><value><int>1</int></value></member><member><name>b</name><value><string>two</string></value></member><member><name>c</name><value><nil/></value></member></struct></value></param><param><value><struct><member><name>y</name><value><int>25</int></value></member><member><name>z</name><value><int>26</int></value></member></struct></value></param></params></methodResponse>"
+	if xml != expected {
+		t.Error("RPC2XML map conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+}
+
+type StructPtrRpc2Xml struct {
+	Int *int
+	Sub *SubStructRpc2Xml
+	Nil *SubStructRpc2Xml
+}
+
+func TestRPC2XMLPointers(t *testing.T) {
+	i := 42
+	req := &StructPtrRpc2Xml{&i, &SubStructRpc2Xml{Foo: 1, Bar: "bar"}, nil}
+	xml, err := rpcResponse2XML(req)
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodResponse><params><param><value><int>42</int></value></param><param><value><struct><member><name>Foo</name><value><int>1</int></value></member><member><name>Bar</name><value><string>bar</string></value></member><member><name>Data</name><value><array><data></data></array></value></member></struct></value></param><param><value><nil/></value></param></params></methodResponse>"
+	if xml != expected {
+		t.Error("RPC2XML pointers conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+}
+
+type StructTagsRpc2Xml struct {
+	ID      int    `xmlrpc:"blog_id"`
+	Title   string `xmlrpc:"title,omitempty"`
+	Body    string `xmlrpc:",omitempty"`
+	Skipped string `xmlrpc:"-"`
+	Legacy  string `xml:"legacy_name"`
+	private string
+}
+
+type StructTagsParamRpc2Xml struct {
+	Post StructTagsRpc2Xml
+}
+
+func TestRPC2XMLTags(t *testing.T) {
+	req := &StructTagsParamRpc2Xml{StructTagsRpc2Xml{ID: 1, Body: "text", Skipped: "skip", Legacy: "legacy", private: "private"}}
+	xml, err := rpcResponse2XML(req)
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodResponse><params><param><value><struct><member><name>blog_id</name><value><int>1</int></value></member><member><name>Body</name><value><string>text</string></value></member><member><name>legacy_name</name><value><string>legacy</string></value></member></struct></value></param></params></methodResponse>"
+	if xml != expected {
+		t.Error("RPC2XML tags conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+}
+
+type AuthRpc2Xml struct {
+	User  string
+	Token string `xmlrpc:"token"`
+}
+
+type PageRpc2Xml struct {
+	Page  int
+	Token string
+}
+
+type StructEmbeddedRpc2Xml struct {
+	AuthRpc2Xml
+	*PageRpc2Xml
+	Sub   SubStructRpc2Xml `xmlrpc:"sub"`
+	Inner AuthRpc2Xml      `xmlrpc:"-"`
+	User  string
+}
+
+type StructEmbeddedParamRpc2Xml struct {
+	Req StructEmbeddedRpc2Xml
+}
+
+func TestRPC2XMLEmbedded(t *testing.T) {
+	req := &StructEmbeddedParamRpc2Xml{StructEmbeddedRpc2Xml{
+		AuthRpc2Xml: AuthRpc2Xml{User: "hidden", Token: "secret"},
+		PageRpc2Xml: &PageRpc2Xml{Page: 2, Token: "shadowed"},
+		User:        "john",
+	}}
+	xml, err := rpcResponse2XML(req)
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodResponse><params><param><value><struct><member><name>token</name><value><string>secret</string></value></member><member><name>Page</name><value><int>2</int></value></member><member><name>Token</name><value><string>shadowed</string></value></member><member><name>sub</name><value><struct><member><name>Foo</name><value><int>0</int></value></member><member><name>Bar</name><value><string></string></value></member><member><name>Data</name><value><array><data></data></array></value></member></struct></value></member><member><name>User</name><value><string>john</string></value></member></struct></value></param></params></methodResponse>"
+	if xml != expected {
+		t.Error("RPC2XML embedded conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+
+	req.Req.PageRpc2Xml = nil
+	xml, err = rpcResponse2XML(req)
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected = "<methodResponse><params><param><value><struct><member><name>token</name><value><string>secret</string></value></member><member><name>sub</name><value><struct><member><name>Foo</name><value><int>0</int></value></member><member><name>Bar</name><value><string></string></value></member><member><name>Data</name><value><array><data></data></array></value></member></struct></value></member><member><name>User</name><value><string>john</string></value></member></struct></value></param></params></methodResponse>"
+	if xml != expected {
+		t.Error("RPC2XML nil embedded conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+}
+
+// Celsius is encoded as the struct with the unit.
+type Celsius float64
+
+func (c Celsius) MarshalXMLRPC() ([]byte, error) {
+	return []byte(fmt.Sprintf("<value><struct><member><name>degrees</name><value><double>%.1f</double></value></member><member><name>unit</name><value><string>C</string></value></member></struct></value>", float64(c))), nil
+}
+
+type BadMarshaler struct{}
+
+func (BadMarshaler) MarshalXMLRPC() ([]byte, error) {
+	return []byte("<int>1</int>"), nil
+}
+
+type StructMarshalerRpc2Xml struct {
+	Temp Celsius
+	IP   net.IP
+}
+
+func TestRPC2XMLMarshaler(t *testing.T) {
+	req := &StructMarshalerRpc2Xml{21.5, net.IPv4(10, 0, 0, 1)}
+	xml, err := rpcResponse2XML(req)
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodResponse><params><param><value><struct><member><name>degrees</name><value><double>21.5</double></value></member><member><name>unit</name><value><string>C</string></value></member></struct></value></param><param><value><string>10.0.0.1</string></value></param></params></methodResponse>"
+	if xml != expected {
+		t.Error("RPC2XML marshaler conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+
+	if _, err := rpcResponse2XML(&struct{ Bad BadMarshaler }{}); err == nil {
+		t.Error("expected error for invalid MarshalXMLRPC output, but got nil")
+	}
+}
+
+type SubStructErrorRpc2Xml struct {
+	Data []interface{}
+}
+
+type StructErrorRpc2Xml struct {
+	Sub SubStructErrorRpc2Xml
+}
+
+func TestRPC2XMLErrors(t *testing.T) {
+	tests := []struct {
+		req  interface{}
+		path string
+		err  string
+	}{
+		{&StructErrorRpc2Xml{SubStructErrorRpc2Xml{[]interface{}{1, "two", make(chan int)}}}, "Sub.Data[2]", "Sub.Data[2]: unsupported type chan int"},
+		{&struct{ F func() }{func() {}}, "F", "F: unsupported type func()"},
+		{&struct{ C complex128 }{1i}, "C", "C: unsupported type complex128"},
+		{&struct{ M map[string]interface{} }{map[string]interface{}{"key": 1 << 40}}, "M[key]", "M[key]: unsupported value: integer 1099511627776 overflows <int>"},
+		{&struct{ M map[int]string }{map[int]string{1: "one"}}, "M", "M: unsupported type map[int]string"},
+		{&StructRestRpc2Xml{"info", []interface{}{1, make(chan int)}}, "Args[1]", "Args[1]: unsupported type chan int"},
+		{&struct {
+			Rest []int `xmlrpc:",rest"`
+			Last int
+		}{}, "", "rest field Rest must be the last field and a slice"},
+	}
+	for _, tt := range tests {
+		_, err := rpcResponse2XML(tt.req)
+		encErr, ok := err.(*EncodeError)
+		if !ok {
+			t.Errorf("expected *EncodeError, but got %#v", err)
+			continue
+		}
+		if encErr.Path != tt.path {
+			t.Errorf("expected path %q, but got %q", tt.path, encErr.Path)
+		}
+		if err.Error() != tt.err {
+			t.Errorf("expected error %q, but got %q", tt.err, err.Error())
+		}
+	}
+
+	if _, err := EncodeClientRequest("Some.Method", &StructErrorRpc2Xml{SubStructErrorRpc2Xml{[]interface{}{make(chan int)}}}); err == nil {
+		t.Error("expected EncodeClientRequest to fail, but got nil")
+	}
+}
+
+func TestEncoderReuse(t *testing.T) {
+	for _, charset := range []string{"", "ISO-8859-1"} {
+		var buf bytes.Buffer
+		encoder := NewEncoder(&buf)
+		encoder.SetOptions(EncoderOptions{Charset: charset})
+		if err := encoder.EncodeResponse(&struct {
+			A int
+			C chan int
+		}{1, nil}); err == nil {
+			t.Error("expected EncodeResponse to fail, but got nil")
+		}
+		if err := encoder.EncodeValue([]interface{}{"café", make(chan int)}); err == nil {
+			t.Error("expected EncodeValue to fail, but got nil")
+		}
+		if err := encoder.EncodeFault(Fault{Code: 1, String: "fault", Detail: &FaultDetail{"C": make(chan int)}}); err == nil {
+			t.Error("expected EncodeFault to fail, but got nil")
+		}
+		buf.Reset()
+
+		if err := encoder.EncodeResponse(&struct{ A int }{1}); err != nil {
+			t.Fatal(err)
+		}
+		expected := "<methodResponse><params><param><value><int>1</int></value></param></params></methodResponse>"
+		if charset != "" {
+			expected = `<?xml version="1.0" encoding="ISO-8859-1"?>` + expected
+		}
+		if buf.String() != expected {
+			t.Error("Expected", expected)
+			t.Error("Got", buf.String())
+		}
+	}
+}
+
+type StructRestRpc2Xml struct {
+	Level string
+	Args  []interface{} `xmlrpc:",rest"`
+}
+
+func TestRPC2XMLRestParams(t *testing.T) {
+	xml, err := rpcRequest2XML("log.write", &StructRestRpc2Xml{"info", []interface{}{"started", 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "<methodCall><methodName>log.write</methodName><params><param><value><string>info</string></value></param><param><value><string>started</string></value></param><param><value><int>2</int></value></param></params></methodCall>"
+	if xml != expected {
+		t.Error("RPC2XML conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+
+	res := new(StructRestRpc2Xml)
+	if err := xml2RPC(xml, res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, &StructRestRpc2Xml{"info", []interface{}{"started", 2}}) {
+		t.Error("Expected", &StructRestRpc2Xml{"info", []interface{}{"started", 2}})
+		t.Error("Got", res)
+	}
+}
+
+func TestRPC2XMLCharset(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	encoder.SetOptions(EncoderOptions{Charset: "ISO-8859-1"})
+	if err := encoder.EncodeResponse(&struct{ Str string }{"café <€>"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?><methodResponse><params><param><value><string>caf\xe9 &lt;&#8364;&gt;</string></value></param></params></methodResponse>"
+	if buf.String() != expected {
+		t.Error("Expected", expected)
+		t.Error("Got", buf.String())
+	}
+
+	res := new(struct{ Str string })
+	if err := xml2RPC(buf.String(), res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Str != "café <€>" {
+		t.Errorf("expected %q, but got %q", "café <€>", res.Str)
+	}
+
+	// Runes split between the buffered writes.
+	long := strings.Repeat("é€", 3000)
+	buf.Reset()
+	encoder = NewEncoder(&buf)
+	encoder.SetOptions(EncoderOptions{Charset: "ISO-8859-1"})
+	if err := encoder.EncodeResponse(&struct{ Str string }{long}); err != nil {
+		t.Fatal(err)
+	}
+	if err := xml2RPC(buf.String(), res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Str != long {
+		t.Error("long string round trip failed")
+	}
+
+	encoder = NewEncoder(ioutil.Discard)
+	encoder.SetOptions(EncoderOptions{Charset: "EBCDIC-1"})
+	if err := encoder.EncodeResponse(&struct{ Str string }{"str"}); err == nil || err.Error() != `unsupported charset "EBCDIC-1"` {
+		t.Error("expected unsupported charset error, but got", err)
+	}
+}
+
+type HashRpc2Xml []byte
+
+type GradeRpc2Xml byte
+
+func (g GradeRpc2Xml) MarshalText() ([]byte, error) {
+	return []byte{'A' + byte(g)}, nil
+}
+
+type StructBytesRpc2Xml struct {
+	Hash   HashRpc2Xml
+	Array  [4]byte
+	Grades []GradeRpc2Xml
+}
+
+func TestRPC2XMLBytes(t *testing.T) {
+	req := &StructBytesRpc2Xml{HashRpc2Xml("hash"), [4]byte{1, 2, 3, 4}, []GradeRpc2Xml{0, 1}}
+	xml, err := rpcResponse2XML(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "<methodResponse><params><param><value><base64>aGFzaA==</base64></value></param><param><value><base64>AQIDBA==</base64></value></param><param><value><array><data><value><string>A</string></value><value><string>B</string></value></data></array></value></param></params></methodResponse>"
+	if xml != expected {
+		t.Error("RPC2XML conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+
+	res := new(struct {
+		Hash   HashRpc2Xml
+		Array  [4]byte
+		Grades []string
+	})
+	if err := xml2RPC(xml, res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Hash, req.Hash) || res.Array != req.Array {
+		t.Error("Expected", req.Hash, req.Array)
+		t.Error("Got", res.Hash, res.Array)
+	}
+
+	err = xml2RPC("<methodResponse><params><param><value><base64>AQID</base64></value></param></params></methodResponse>", new(struct{ Array [4]byte }))
+	expected_err := Fault{Code: -32602, String: "Invalid Method Parameters: base64 length mismatch: 3 != 4"}
+	if err != expected_err {
+		t.Error("Expected", expected_err)
+		t.Error("Got", err)
+	}
+}
+
+type StructDoublesRpc2Xml struct {
+	Small  float64
+	Large  float64
+	Single float32
+	Third  float64
+}
+
+func TestRPC2XMLDoubles(t *testing.T) {
+	req := &StructDoublesRpc2Xml{1e-9, 1.5e20, 0.1, 1.0 / 3}
+	xml, err := rpcResponse2XML(req)
+	if err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected := "<methodResponse><params><param><value><double>0.000000001</double></value></param><param><value><double>150000000000000000000</double></value></param><param><value><double>0.1</double></value></param><param><value><double>0.3333333333333333</double></value></param></params></methodResponse>"
+	if xml != expected {
+		t.Error("RPC2XML doubles conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", xml)
+	}
+
+	res := new(StructDoublesRpc2Xml)
+	if err := xml2RPC(xml, res); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if *res != *req {
+		t.Errorf("doubles round trip mismatch: %v != %v", res, req)
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetOptions(EncoderOptions{DoublePrecision: 2})
+	if err := enc.EncodeResponse(&struct{ F float64 }{1.0 / 3}); err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+	expected = "<methodResponse><params><param><value><double>0.33</double></value></param></params></methodResponse>"
+	if buf.String() != expected {
+		t.Error("RPC2XML double precision conversion failed")
+		t.Error("Expected", expected)
+		t.Error("Got", buf.String())
+	}
+
+	for _, f := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if _, err := rpcResponse2XML(&struct{ F float64 }{f}); err == nil {
+			t.Errorf("expected error for %v, but got nil", f)
+		}
+	}
+}
+
+func TestRPC2XMLTimeZone(t *testing.T) {
+	req := &struct{ Time time.Time }{time.Date(2012, time.July, 17, 14, 8, 55, 0, time.FixedZone("EEST", 3*3600))}
+	tests := []struct {
+		opts     EncoderOptions
+		expected string
+	}{
+		{EncoderOptions{}, "20120717T14:08:55"},
+		{EncoderOptions{Location: time.UTC}, "20120717T11:08:55"},
+		{EncoderOptions{Location: time.UTC, TimeZone: true}, "20120717T11:08:55Z"},
+		{EncoderOptions{TimeZone: true}, "20120717T14:08:55+03:00"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.SetOptions(tt.opts)
+		if err := enc.EncodeResponse(req); err != nil {
+			t.Error("RPC2XML conversion failed", err)
+		}
+		expected := "<methodResponse><params><param><value><dateTime.iso8601>" + tt.expected + "</dateTime.iso8601></value></param></params></methodResponse>"
+		if buf.String() != expected {
+			t.Error("RPC2XML time zone conversion failed")
+			t.Error("Expected", expected)
+			t.Error("Got", buf.String())
+		}
+	}
+}
+
+type NodeRpc2Xml struct {
+	Name string
+	Next *NodeRpc2Xml
+}
+
+func TestRPC2XMLCycles(t *testing.T) {
+	node := &NodeRpc2Xml{Name: "a"}
+	node.Next = &NodeRpc2Xml{Name: "b", Next: node}
+
+	m := map[string]interface{}{}
+	m["self"] = m
+
+	s := []interface{}{1, nil}
+	s[1] = s
+
+	tests := []struct {
+		req interface{}
+		err string
+	}{
+		{&struct{ Node *NodeRpc2Xml }{node}, "Node.Next.Next: unsupported value: encountered a cycle via *xml.NodeRpc2Xml"},
+		{&struct{ Map map[string]interface{} }{m}, "Map[self]: unsupported value: encountered a cycle via map[string]interface {}"},
+		{&struct{ Slice []interface{} }{s}, "Slice[1]: unsupported value: encountered a cycle via []interface {}"},
+	}
+	for _, tt := range tests {
+		_, err := rpcResponse2XML(tt.req)
+		if err == nil {
+			t.Errorf("expected error %q, but got nil", tt.err)
+		} else if err.Error() != tt.err {
+			t.Errorf("expected error %q, but got %q", tt.err, err.Error())
+		}
+	}
+
+	// The same pointer may appear several times without a cycle.
+	shared := &NodeRpc2Xml{Name: "shared"}
+	if _, err := rpcResponse2XML(&struct{ A, B *NodeRpc2Xml }{shared, shared}); err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+}
+
+func TestRPC2XMLMaxDepth(t *testing.T) {
+	var list *NodeRpc2Xml
+	for i := 0; i < 10; i++ {
+		list = &NodeRpc2Xml{Name: "node", Next: list}
+	}
+	req := &struct{ List *NodeRpc2Xml }{list}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetOptions(EncoderOptions{MaxDepth: 5})
+	err := enc.EncodeResponse(req)
+	if err == nil {
+		t.Fatal("expected max depth error, but got nil")
+	}
+	expected := "List.Next.Next.Next.Next.Name: unsupported value: exceeded maximum depth of 5"
+	if err.Error() != expected {
+		t.Errorf("expected error %q, but got %q", expected, err.Error())
+	}
+
+	if _, err := rpcResponse2XML(req); err != nil {
+		t.Error("RPC2XML conversion failed", err)
+	}
+}
+
+func BenchmarkRPC2XML(b *testing.B) {
+	req := &StructRpc2Xml{123, 3.145926, "Hello, World!", false, SubStructRpc2Xml{42, "I'm Bar", []int{1, 2, 3}}, time.Date(2012, time.July, 17, 14, 8, 55, 0, time.Local), []byte("you can't read this!")}
+	enc := NewEncoder(ioutil.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := enc.EncodeRequest("Some.Method", req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -5,9 +5,10 @@
 package xml
 
 import (
+	"bytes"
 	"encoding/xml"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 
 	"github.com/gorilla/rpc"
@@ -26,7 +27,9 @@ func NewCodec() *Codec {
 
 // Codec creates a CodecRequest to process each request.
 type Codec struct {
-	aliases map[string]string
+	aliases        map[string]string
+	encoderOptions EncoderOptions
+	decoderOptions DecoderOptions
 }
 
 // RegisterAlias creates a method alias
@@ -34,23 +37,33 @@ func (c *Codec) RegisterAlias(alias, method string) {
 	c.aliases[alias] = method
 }
 
+// SetEncoderOptions sets the options used to encode responses.
+func (c *Codec) SetEncoderOptions(opts EncoderOptions) {
+	c.encoderOptions = opts
+}
+
+// SetDecoderOptions sets the options used to decode requests.
+func (c *Codec) SetDecoderOptions(opts DecoderOptions) {
+	c.decoderOptions = opts
+}
+
 // NewRequest returns a CodecRequest.
+//
+// Only the method name is read here, the params are decoded
+// from the request body later by ReadRequest.
 func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
-	rawxml, err := ioutil.ReadAll(r.Body)
+	decoder := NewDecoder(r.Body)
+	decoder.SetOptions(c.decoderOptions)
+	method, err := decoder.methodName()
 	if err != nil {
-		return &CodecRequest{err: err}
+		return &CodecRequest{err: err, encoderOptions: c.encoderOptions}
 	}
-	defer r.Body.Close()
 
-	var request ServerRequest
-	if err := xml.Unmarshal(rawxml, &request); err != nil {
-		return &CodecRequest{err: err}
-	}
-	request.rawxml = string(rawxml)
+	request := ServerRequest{Name: xml.Name{Local: "methodCall"}, Method: method}
 	if method, ok := c.aliases[request.Method]; ok {
 		request.Method = method
 	}
-	return &CodecRequest{request: &request}
+	return &CodecRequest{request: &request, decoder: decoder, encoderOptions: c.encoderOptions}
 }
 
 // ----------------------------------------------------------------------------
@@ -60,13 +73,14 @@ func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
 type ServerRequest struct {
 	Name   xml.Name `xml:"methodCall"`
 	Method string   `xml:"methodName"`
-	rawxml string
 }
 
 // CodecRequest decodes and encodes a single request.
 type CodecRequest struct {
-	request *ServerRequest
-	err     error
+	request        *ServerRequest
+	decoder        *Decoder
+	err            error
+	encoderOptions EncoderOptions
 }
 
 // Method returns the RPC method for the current request.
@@ -82,9 +96,9 @@ func (c *CodecRequest) Method() (string, error) {
 // ReadRequest fills the request object for the RPC method.
 //
 // args is the pointer to the Service.Args structure
-// it gets populated from temporary XML structure
+// it gets populated straight from the request body
 func (c *CodecRequest) ReadRequest(args interface{}) error {
-	c.err = xml2RPC(c.request.rawxml, args)
+	c.err = c.decoder.params2RPC(args)
 	return nil
 }
 
@@ -92,23 +106,45 @@ func (c *CodecRequest) ReadRequest(args interface{}) error {
 //
 // response is the pointer to the Service.Response structure
 // it gets encoded into the XML-RPC xml string
+//
+// If the request can't be decoded or the method returns an error, the
+// fault is written instead. The Fault error is sent as is, along with
+// its Detail, other errors are sent as FaultApplicationError.
 func (c *CodecRequest) WriteResponse(w http.ResponseWriter, response interface{}, methodErr error) error {
-	var xmlstr string
-	if c.err != nil {
+	// The response is buffered, so the encoding error can still
+	// be reported as a fault instead of the malformed XML.
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	encoder.SetOptions(c.encoderOptions)
+
+	err := c.err
+	if err == nil {
+		err = methodErr
+	}
+	if err != nil {
 		var fault Fault
-		switch c.err.(type) {
-		case Fault:
-			fault = c.err.(Fault)
-		default:
+		if !errors.As(err, &fault) {
 			fault = FaultApplicationError
-			fault.String += fmt.Sprintf(": %v", c.err)
+			fault.String += fmt.Sprintf(": %v", err)
 		}
-		xmlstr = fault2XML(fault)
+		err = encoder.EncodeFault(fault)
 	} else {
-		xmlstr, _ = rpcResponse2XML(response)
+		err = encoder.EncodeResponse(response)
+	}
+	if err != nil {
+		// The fault is written in UTF-8, as the charset
+		// might be the cause of the error.
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		fault := FaultInternalError
+		fault.String += fmt.Sprintf(": %v", err)
+		return NewEncoder(w).EncodeFault(fault)
 	}
 
-	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
-	w.Write([]byte(xmlstr))
-	return nil
+	charset := "utf-8"
+	if c.encoderOptions.Charset != "" {
+		charset = c.encoderOptions.Charset
+	}
+	w.Header().Set("Content-Type", "text/xml; charset="+charset)
+	_, err = buf.WriteTo(w)
+	return err
 }
@@ -5,176 +5,1318 @@
 package xml
 
 import (
+	"bufio"
 	"bytes"
+	"encoding"
 	"encoding/base64"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
-	"unicode"
-	"unicode/utf8"
 
 	"github.com/rogpeppe/go-charset/charset"
 	_ "github.com/rogpeppe/go-charset/data"
 )
 
-// Types used for unmarshalling
-type response struct {
-	Name   xml.Name   `xml:"methodResponse"`
-	Params []param    `xml:"params>param"`
-	Fault  faultValue `xml:"fault,omitempty"`
+// DecoderOptions controls the optional behaviour of the Decoder.
+type DecoderOptions struct {
+	// Coerce allows the values of the mismatching types to be converted,
+	// where it's safe: <int>, <i4> and <i8> into float fields, if the
+	// float type holds the integer exactly, and <string> or untyped
+	// values holding numbers or booleans into numeric and bool fields.
+	// Without it, such values are reported as the type mismatch.
+	Coerce bool
+
+	// DisallowUnknownMembers rejects the struct members, which don't
+	// match any field of the destination struct, with the fault naming
+	// them. By default, such members are ignored.
+	DisallowUnknownMembers bool
+
+	// SnakeCase matches the struct members to the fields ignoring the
+	// underscores, after the exact and case-insensitive matches fail,
+	// e.g. "blog_id" is stored into the BlogID field.
+	SnakeCase bool
+
+	// MaxDepth is the maximum nesting of values, which is 1000 by
+	// default, counted the same way as EncoderOptions.MaxDepth. Deeper
+	// documents are rejected with FaultDecode, so hostile input can't
+	// exhaust the stack.
+	MaxDepth int
+}
+
+// Decoder reads XML-RPC method calls and responses from an input stream.
+//
+// The XML tokens are decoded straight into the destination, without
+// building the intermediate document in memory.
+type Decoder struct {
+	d     *xml.Decoder
+	in    *recorder
+	opts  DecoderOptions
+	depth int
+
+	// values is the number of the nested <value> elements.
+	values int
+
+	// strict is set by Unmarshal to reject anything but whitespace
+	// after the type element of each value.
+	strict bool
+
+	// converted is set, if the document is converted from another
+	// charset, so the raw input can't be captured.
+	converted bool
+}
+
+// recorder is the input of xml.Decoder, which keeps the bytes read while
+// recording. It implements io.ByteReader, so xml.Decoder doesn't buffer
+// it and the bytes recorded are exactly the ones decoded.
+type recorder struct {
+	r   byteReader
+	buf []byte
+	on  bool
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
 }
 
-type param struct {
-	Value value `xml:"value"`
+func (r *recorder) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil && r.on {
+		r.buf = append(r.buf, b)
+	}
+	return b, err
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.on {
+		r.buf = append(r.buf, p[:n]...)
+	}
+	return n, err
+}
+
+// NewDecoder returns a new decoder that reads from r. Documents
+// in the encodings other than UTF-8 are converted, if the encoding
+// is declared in the XML header.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	d := &Decoder{in: &recorder{r: br}}
+	d.d = xml.NewDecoder(d.in)
+	d.d.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		d.converted = true
+		return charset.NewReader(label, input)
+	}
+	return d
 }
 
-type value struct {
-	Array    []value  `xml:"array>data>value"`
-	Struct   []member `xml:"struct>member"`
-	String   string   `xml:"string"`
-	Int      string   `xml:"int"`
-	Int4     string   `xml:"i4"`
-	Double   string   `xml:"double"`
-	Boolean  string   `xml:"boolean"`
-	DateTime string   `xml:"dateTime.iso8601"`
-	Base64   string   `xml:"base64"`
-	Raw      string   `xml:",innerxml"` // the value can be defualt string
+// SetOptions changes the options used by the decoder.
+func (d *Decoder) SetOptions(opts DecoderOptions) {
+	d.opts = opts
 }
 
-type member struct {
-	Name  string `xml:"name"`
-	Value value  `xml:"value"`
+// DecodeRequest reads the methodCall from the stream, storing the
+// call parameters into args, and returns the method name.
+//
+// args is the pointer to the structure, which fields are
+// filled with the parameters in order.
+func (d *Decoder) DecodeRequest(args interface{}) (string, error) {
+	method, err := d.methodName()
+	if err != nil {
+		return "", err
+	}
+	return method, d.params2RPC(args)
+}
+
+// DecodeResponse reads the methodResponse from the stream, storing
+// the response parameters into reply. The fault response is
+// returned as the Fault error.
+//
+// reply is the pointer to the structure, which fields are
+// filled with the parameters in order.
+func (d *Decoder) DecodeResponse(reply interface{}) error {
+	if _, err := d.root("methodResponse"); err != nil {
+		return err
+	}
+	return d.params2RPC(reply)
+}
+
+// DecodeValue reads the single <value> element from the stream and
+// stores it in the value pointed to by v.
+func (d *Decoder) DecodeValue(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("DecodeValue requires non-nil pointer, got %T", v)
+	}
+	if _, err := d.root("value"); err != nil {
+		return err
+	}
+	return d.value2Field(rv.Elem(), typeDecoder(rv.Elem().Type()))
 }
 
 func xml2RPC(xmlraw string, rpc interface{}) error {
-	// Unmarshal raw XML into the temporal structure
-	var ret response
-	decoder := xml.NewDecoder(bytes.NewReader([]byte(xmlraw)))
-	decoder.CharsetReader = charset.NewReader
-	err := decoder.Decode(&ret)
+	d := NewDecoder(strings.NewReader(xmlraw))
+	if _, err := d.root(""); err != nil {
+		return err
+	}
+	return d.params2RPC(rpc)
+}
+
+// token returns the next XML token, keeping track of the element depth
+// and the value nesting. Errors of the underlying reader are returned as
+// FaultSystemError and malformed XML, including the values nested deeper
+// than MaxDepth, as FaultDecode.
+func (d *Decoder) token() (xml.Token, error) {
+	tok, err := d.d.Token()
 	if err != nil {
-		return FaultDecode
+		return nil, tokenError(err)
 	}
+	switch t := tok.(type) {
+	case xml.StartElement:
+		d.depth++
+		if t.Name.Local != "value" {
+			break
+		}
+		d.values++
+		maxDepth := d.opts.MaxDepth
+		if maxDepth <= 0 {
+			maxDepth = defaultMaxDepth
+		}
+		if d.values > maxDepth {
+			return nil, FaultDecode
+		}
+	case xml.EndElement:
+		d.depth--
+		if t.Name.Local == "value" {
+			d.values--
+		}
+	}
+	return tok, nil
+}
 
-	if !ret.Fault.IsEmpty() {
-		return getFaultResponse(ret.Fault)
+// tokenError returns the fault for the error reading the next token.
+func tokenError(err error) error {
+	if _, ok := err.(*xml.SyntaxError); ok || err == io.EOF {
+		return FaultDecode
 	}
+	return FaultSystemError
+}
 
-	// Structures should have equal number of fields
-	if reflect.TypeOf(rpc).Elem().NumField() != len(ret.Params) {
-		return FaultWrongArgumentsNumber
+// end checks that only whitespace and comments are left in the input
+// after the root element.
+func (d *Decoder) end() error {
+	for {
+		tok, err := d.d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return tokenError(err)
+		}
+		switch t := tok.(type) {
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) != 0 {
+				return FaultDecode
+			}
+		case xml.Comment:
+		default:
+			return FaultDecode
+		}
 	}
+}
 
-	// Now, convert temporal structure into the
-	// passed rpc variable, according to it's structure
-	for i, param := range ret.Params {
-		field := reflect.ValueOf(rpc).Elem().Field(i)
-		err = value2Field(param.Value, &field)
+// next returns the next start or end element, skipping the text,
+// comments and processing instructions.
+func (d *Decoder) next() (xml.Token, error) {
+	for {
+		tok, err := d.token()
 		if err != nil {
+			return nil, err
+		}
+		switch tok.(type) {
+		case xml.StartElement, xml.EndElement:
+			return tok, nil
+		}
+	}
+}
+
+// skip consumes the tokens up to the end of the element at depth.
+func (d *Decoder) skip(depth int) error {
+	for d.depth >= depth {
+		if _, err := d.token(); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
+// expect reads the next start element, failing if it's not named name.
+func (d *Decoder) expect(name string) error {
+	tok, err := d.next()
+	if err != nil {
+		return err
+	}
+	if start, ok := tok.(xml.StartElement); !ok || start.Name.Local != name {
+		return FaultDecode
+	}
 	return nil
 }
 
-// getFaultResponse converts faultValue to Fault.
-func getFaultResponse(fault faultValue) Fault {
-	var (
-		code int
-		str  string
-	)
+// text reads the character data up to the end of the current element.
+func (d *Decoder) text() ([]byte, error) {
+	var buf []byte
+	for {
+		tok, err := d.token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.CharData:
+			buf = append(buf, t...)
+		case xml.StartElement:
+			return nil, FaultDecode
+		case xml.EndElement:
+			return buf, nil
+		}
+	}
+}
+
+// root reads the document root element, which must be named name,
+// unless name is empty.
+func (d *Decoder) root(name string) (xml.StartElement, error) {
+	tok, err := d.next()
+	if err != nil {
+		return xml.StartElement{}, err
+	}
+	start, ok := tok.(xml.StartElement)
+	if !ok || name != "" && start.Name.Local != name {
+		return xml.StartElement{}, FaultDecode
+	}
+	return start, nil
+}
+
+// methodName reads the methodCall root and its methodName.
+func (d *Decoder) methodName() (string, error) {
+	if _, err := d.root("methodCall"); err != nil {
+		return "", err
+	}
+	if err := d.expect("methodName"); err != nil {
+		return "", err
+	}
+	name, err := d.text()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(name)), nil
+}
+
+// params2RPC reads the rest of the root element, storing the params into
+// the passed rpc variable, according to it's structure. The fault is
+// returned as the Fault error.
+func (d *Decoder) params2RPC(rpc interface{}) error {
+	v := reflect.ValueOf(rpc).Elem()
+	plan := typeParams(v.Type())
+	if plan.err != nil {
+		fault := FaultInternalError
+		fault.String += fmt.Sprintf(": %v", plan.err)
+		return fault
+	}
+	fields, rest := plan.fields, plan.rest
+	var restField reflect.Value
+	if rest != nil {
+		restField = fieldByIndexAlloc(v, rest.index)
+		if !restField.CanSet() {
+			return FaultApplicationError
+		}
+		restField.Set(reflect.Zero(rest.typ))
+	}
+
+	n := 0
+	for d.depth > 0 {
+		tok, err := d.next()
+		if err != nil {
+			return err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "params":
+		case "param":
+			if n >= len(fields) && rest == nil {
+				// count the extra params to report them
+				n++
+				if err := d.skip(d.depth); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.expect("value"); err != nil {
+				return err
+			}
+			var (
+				field reflect.Value
+				dec   *decoder
+			)
+			if n < len(fields) {
+				field, dec = fieldByIndexAlloc(v, fields[n].index), plan.decoders[n]
+			} else {
+				restField.Set(reflect.Append(restField, reflect.Zero(rest.typ.Elem())))
+				field, dec = restField.Index(n-len(fields)), plan.restDecoder
+			}
+			if err := d.value2Field(field, dec); err != nil {
+				return err
+			}
+			n++
+			if err := d.skip(d.depth); err != nil {
+				return err
+			}
+		case "fault":
+			if err := d.expect("value"); err != nil {
+				return err
+			}
+			return d.fault()
+		default:
+			if err := d.skip(d.depth); err != nil {
+				return err
+			}
+		}
+	}
+
+	return params2Defaults(v, plan, n)
+}
+
+// paramsPlan holds the fields of the struct type receiving the params,
+// along with their decoders and converted defaults. The invalid default
+// is reported by err, so it shows up on the first use of the type.
+type paramsPlan struct {
+	fields      []fieldInfo
+	decoders    []*decoder
+	defaults    []reflect.Value
+	rest        *fieldInfo
+	restDecoder *decoder
+	err         error
+}
+
+// paramsCache maps reflect.Type to its *paramsPlan.
+var paramsCache sync.Map
+
+// typeParams returns the paramsPlan for the struct type t, building it
+// on the first use.
+func typeParams(t reflect.Type) *paramsPlan {
+	if plan, ok := paramsCache.Load(t); ok {
+		return plan.(*paramsPlan)
+	}
+
+	plan := new(paramsPlan)
+	plan.fields, plan.rest, plan.err = splitRest(cachedTypeFields(t).list)
+	if plan.err == nil {
+		plan.decoders = make([]*decoder, len(plan.fields))
+		for i, f := range plan.fields {
+			plan.decoders[i] = typeDecoder(f.typ)
+		}
+		if plan.rest != nil {
+			plan.restDecoder = typeDecoder(plan.rest.typ.Elem())
+		}
+		plan.defaults, plan.err = params2Plan(plan.fields)
+	}
+	plani, _ := paramsCache.LoadOrStore(t, plan)
+	return plani.(*paramsPlan)
+}
 
-	for _, field := range fault.Value.Struct {
-		if field.Name == "faultCode" {
-			code, _ = strconv.Atoi(field.Value.Int)
-		} else if field.Name == "faultString" {
-			str = field.Value.String
-			if str == "" {
-				str = field.Value.Raw
+// params2Plan converts the defaults of the fields from their struct tags.
+func params2Plan(fields []fieldInfo) ([]reflect.Value, error) {
+	defaults := make([]reflect.Value, len(fields))
+	for i, f := range fields {
+		if !f.hasDefault {
+			continue
+		}
+		def := reflect.New(f.typ).Elem()
+		if err := default2Field(f.def, def); err != nil {
+			if fault, ok := err.(Fault); ok {
+				// the code means nothing to the server developer
+				err = errors.New(fault.String)
 			}
+			return nil, fmt.Errorf("invalid default %q of %s: %v", f.def, f.name, err)
+		}
+		defaults[i] = def
+	}
+	return defaults, nil
+}
+
+// params2Defaults checks that the n params received are enough for the
+// fields of plan, and stores the defaults into the missing optional
+// params. With the rest field, any number of extra params is fine.
+func params2Defaults(v reflect.Value, plan *paramsPlan, n int) error {
+	fields, rest := plan.fields, plan.rest != nil
+	required := len(fields)
+	for required > 0 && fields[required-1].optional {
+		required--
+	}
+	if n < required || n > len(fields) && !rest {
+		fault := FaultWrongArgumentsNumber
+		if rest {
+			fault.String += fmt.Sprintf(": expected at least %d params, got %d", required, n)
+		} else if required == len(fields) {
+			fault.String += fmt.Sprintf(": expected %d params, got %d", len(fields), n)
+		} else {
+			fault.String += fmt.Sprintf(": expected %d to %d params, got %d", required, len(fields), n)
 		}
+		return fault
 	}
 
-	return Fault{Code: code, String: str}
+	if n > len(fields) {
+		return nil
+	}
+	for i := n; i < len(fields); i++ {
+		if !fields[i].hasDefault {
+			continue
+		}
+		field := fieldByIndexAlloc(v, fields[i].index)
+		if !field.CanSet() {
+			return FaultApplicationError
+		}
+		setDefault(field, plan.defaults[i])
+	}
+	return nil
+}
+
+// default2Field stores the default value from the struct tag into field,
+// converting it as the string value with the coercion enabled.
+func default2Field(def string, field reflect.Value) error {
+	d := Decoder{opts: DecoderOptions{Coerce: true}}
+	return d.untyped2Field([]byte(def), field)
+}
+
+// setDefault stores the copy of the converted default def into field,
+// so the requests don't share its pointers and slices.
+func setDefault(field, def reflect.Value) {
+	switch def.Kind() {
+	case reflect.Ptr:
+		if !def.IsNil() {
+			p := reflect.New(def.Type().Elem())
+			setDefault(p.Elem(), def.Elem())
+			def = p
+		}
+	case reflect.Slice:
+		if !def.IsNil() {
+			s := reflect.MakeSlice(def.Type(), def.Len(), def.Len())
+			reflect.Copy(s, def)
+			def = s
+		}
+	}
+	field.Set(def)
+}
+
+// fault reads the fault value.
+func (d *Decoder) fault() error {
+	var members map[string]interface{}
+	v := reflect.ValueOf(&members).Elem()
+	if err := d.value2Field(v, typeDecoder(v.Type())); err != nil {
+		return err
+	}
+
+	return members2Fault(members)
 }
 
-func value2Field(value value, field *reflect.Value) error {
+// value2Field decodes the value, which start element has just been read,
+// into the field using dec, the decoder for the field type. The whole
+// value element is consumed, even if it can't be stored into the field.
+func (d *Decoder) value2Field(field reflect.Value, dec *decoder) error {
+	depth := d.depth
+	if err := d.value(field, dec); err != nil {
+		if fatal(err) {
+			return err
+		}
+		return d.skipErr(err, depth)
+	}
+	if d.strict {
+		return d.valueEnd(depth)
+	}
+	return d.skip(depth)
+}
+
+// valueEnd reads the rest of the value element at depth, which type
+// element has been decoded, and checks that only whitespace follows it.
+func (d *Decoder) valueEnd(depth int) error {
+	if err := d.skip(depth + 1); err != nil {
+		return err
+	}
+	for d.depth >= depth {
+		tok, err := d.token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			fault := FaultInvalidParams
+			fault.String += fmt.Sprintf(": unexpected <%s> after the value type", t.Name.Local)
+			return d.skipErr(fault, depth)
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) != 0 {
+				fault := FaultInvalidParams
+				fault.String += fmt.Sprintf(": unexpected text %q after the value type", bytes.TrimSpace(t))
+				return d.skipErr(fault, depth)
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) value(field reflect.Value, dec *decoder) error {
 	if !field.CanSet() {
 		return FaultApplicationError
 	}
 
+	if dec.unmarshal {
+		return d.unmarshaler2Field(field)
+	}
+
+	// Look for the type element, the value with no type
+	// is the string, see http://en.wikipedia.org/wiki/XML-RPC#Data_types
+	var text []byte
+	for {
+		tok, err := d.token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.CharData:
+			text = append(text, t...)
+		case xml.StartElement:
+			return dec.typed(d, t.Name.Local, field)
+		case xml.EndElement:
+			if len(bytes.TrimSpace(text)) == 0 && !dec.stringLike {
+				// The empty value carries no data for the non-string
+				// field, so it's left untouched.
+				return nil
+			}
+			return d.untyped2Field(text, field)
+		}
+	}
+}
+
+// isStringLike reports whether t, after dereferencing the pointers, gets
+// the untyped value as the string: it's the string, the interface or
+// implements encoding.TextUnmarshaler. time.Time isn't, as it's parsed
+// as dateTime.iso8601 instead.
+func isStringLike(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.String || t.Kind() == reflect.Interface {
+		return true
+	}
+	return t != timeType && reflect.PtrTo(t).Implements(textUnmarshalerType)
+}
+
+// untyped2Field stores the text of the value without the type element,
+// which is the string, into field.
+func (d *Decoder) untyped2Field(text []byte, field reflect.Value) error {
+	switch field.Kind() {
+	case reflect.Ptr:
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+		return d.untyped2Field(text, field.Elem())
+	case reflect.Interface:
+		if !reflect.TypeOf("").AssignableTo(field.Type()) {
+			return typeMismatch("string", field.Type())
+		}
+		field.Set(reflect.ValueOf(string(text)))
+		return nil
+	}
+	return d.string2Field(text, field)
+}
+
+// decoder decodes the <value> elements into the values of some type.
+type decoder struct {
+	// unmarshal is set for the Unmarshaler types, which get the whole
+	// value element.
+	unmarshal bool
+	// stringLike is set for the types getting the empty untyped
+	// value as the string, see isStringLike.
+	stringLike bool
+	// typed decodes the content of the type element.
+	typed decoderFunc
+}
+
+// decoderFunc decodes the content of the type element typ, which start
+// element has just been read, into the value of some type.
+type decoderFunc func(d *Decoder, typ string, v reflect.Value) error
+
+// decoderCache maps reflect.Type to its *decoder.
+var decoderCache sync.Map
+
+// typeDecoder returns the decoder for the type t, compiling it
+// on the first use.
+func typeDecoder(t reflect.Type) *decoder {
+	if dec, ok := decoderCache.Load(t); ok {
+		return dec.(*decoder)
+	}
+
+	// Store the indirect decoder first to deal with the recursive types.
+	// It waits for the real func to be compiled and calls it.
 	var (
-		err error
-		val interface{}
+		wg sync.WaitGroup
+		f  decoderFunc
 	)
+	wg.Add(1)
+	dec := &decoder{unmarshal: isUnmarshaler(t), stringLike: isStringLike(t)}
+	dec.typed = func(d *Decoder, typ string, v reflect.Value) error {
+		wg.Wait()
+		return f(d, typ, v)
+	}
+	deci, loaded := decoderCache.LoadOrStore(t, dec)
+	if loaded {
+		return deci.(*decoder)
+	}
+
+	f = newTypeDecoder(t)
+	wg.Done()
+	dec = &decoder{unmarshal: dec.unmarshal, stringLike: dec.stringLike, typed: f}
+	decoderCache.Store(t, dec)
+	return dec
+}
 
-	switch {
-	case value.Int != "":
-		val, _ = strconv.Atoi(value.Int)
-	case value.Int4 != "":
-		val, _ = strconv.Atoi(value.Int4)
-	case value.Double != "":
-		val, _ = strconv.ParseFloat(value.Double, 64)
-	case value.String != "":
-		val = value.String
-	case value.Boolean != "":
-		val = xml2Bool(value.Boolean)
-	case value.DateTime != "":
-		val, err = xml2DateTime(value.DateTime)
-	case value.Base64 != "":
-		val, err = xml2Base64(value.Base64)
-	case len(value.Struct) != 0:
-		if field.Kind() != reflect.Struct {
+// newTypeDecoder compiles the decoderFunc for the type t.
+func newTypeDecoder(t reflect.Type) decoderFunc {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return newPtrDecoder(t)
+	case reflect.Interface:
+		return (*Decoder).xml2Interface
+	case reflect.Struct:
+		if t != timeType {
+			return newStructDecoder(t)
+		}
+	case reflect.Map:
+		return newMapDecoder(t)
+	case reflect.Slice, reflect.Array:
+		return newArrayDecoder(t)
+	}
+	return scalarDecoder
+}
+
+func newPtrDecoder(t reflect.Type) decoderFunc {
+	elemDec := typeDecoder(t.Elem())
+	return func(d *Decoder, typ string, v reflect.Value) error {
+		if typ == "nil" {
+			v.Set(reflect.Zero(t))
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(t.Elem()))
+		}
+		return elemDec.typed(d, typ, v.Elem())
+	}
+}
+
+func newStructDecoder(t reflect.Type) decoderFunc {
+	fields := cachedTypeFields(t)
+	decoders := make([]*decoder, len(fields.list))
+	for i, f := range fields.list {
+		decoders[i] = typeDecoder(f.typ)
+	}
+	return func(d *Decoder, typ string, v reflect.Value) error {
+		if typ != "struct" {
+			return scalarDecoder(d, typ, v)
+		}
+		return d.xml2Struct(v, fields, decoders)
+	}
+}
+
+func newMapDecoder(t reflect.Type) decoderFunc {
+	elemDec := typeDecoder(t.Elem())
+	return func(d *Decoder, typ string, v reflect.Value) error {
+		if typ != "struct" {
+			return scalarDecoder(d, typ, v)
+		}
+		return d.xml2Map(v, elemDec)
+	}
+}
+
+func newArrayDecoder(t reflect.Type) decoderFunc {
+	elemDec := typeDecoder(t.Elem())
+	return func(d *Decoder, typ string, v reflect.Value) error {
+		if typ != "array" {
+			return scalarDecoder(d, typ, v)
+		}
+		return d.xml2Array(v, elemDec)
+	}
+}
+
+// scalarDecoder decodes the scalar type element typ into v. The struct
+// and array elements are rejected, as v isn't of the matching kind.
+func scalarDecoder(d *Decoder, typ string, v reflect.Value) error {
+	switch typ {
+	case "struct":
+		fault := FaultInvalidParams
+		fault.String += fmt.Sprintf(": structure fields mismatch: %s != %s", v.Kind(), reflect.Struct.String())
+		return fault
+	case "array":
+		fault := FaultInvalidParams
+		fault.String += fmt.Sprintf(": array mismatch: %s != %s", v.Kind(), reflect.Slice.String())
+		return fault
+	case "nil":
+		// nil leaves the non-nillable field untouched
+		return nil
+	}
+
+	text, err := d.text()
+	if err != nil {
+		return err
+	}
+	return d.scalar2Field(typ, text, v)
+}
+
+// scalar2Field stores the text of the scalar type element typ into field.
+func (d *Decoder) scalar2Field(typ string, text []byte, field reflect.Value) error {
+	switch typ {
+	case "int", "i4", "i8":
+		if d.opts.Coerce && (field.Kind() == reflect.Float32 || field.Kind() == reflect.Float64) {
+			return int2Double(string(text), &field)
+		}
+		return xml2Int(string(text), &field)
+	case "double":
+		return xml2Double(string(text), &field)
+	case "string":
+		return d.string2Field(text, field)
+	case "boolean":
+		if field.Kind() != reflect.Bool {
+			return typeMismatch("bool", field.Type())
+		}
+		field.SetBool(xml2Bool(strings.TrimSpace(string(text))))
+	case "dateTime.iso8601":
+		if field.Type() != timeType {
+			return typeMismatch("time.Time", field.Type())
+		}
+		t, err := xml2DateTime(string(text))
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(t))
+	case "base64":
+		if field.Kind() != reflect.Slice && field.Kind() != reflect.Array || field.Type().Elem().Kind() != reflect.Uint8 {
+			return typeMismatch("[]uint8", field.Type())
+		}
+		b, err := xml2Base64(text)
+		if err != nil {
+			return err
+		}
+		if field.Kind() == reflect.Slice {
+			field.SetBytes(b)
+			return nil
+		}
+		if len(b) != field.Len() {
 			fault := FaultInvalidParams
-			fault.String += fmt.Sprintf("structure fields mismatch: %s != %s", field.Kind(), reflect.Struct.String())
+			fault.String += fmt.Sprintf(": base64 length mismatch: %d != %d", len(b), field.Len())
 			return fault
 		}
-		s := value.Struct
-		for i := 0; i < len(s); i++ {
-			// Uppercase first letter for field name to deal with
-			// methods in lowercase, which cannot be used
-			field_name := uppercaseFirst(s[i].Name)
-			f := field.FieldByName(field_name)
-			err = value2Field(s[i].Value, &f)
-		}
-	case len(value.Array) != 0:
-		a := value.Array
-		f := *field
-		slice := reflect.MakeSlice(reflect.TypeOf(f.Interface()),
-			len(a), len(a))
-		for i := 0; i < len(a); i++ {
-			item := slice.Index(i)
-			err = value2Field(a[i], &item)
-		}
-		f = reflect.AppendSlice(f, slice)
-		val = f.Interface()
-	case len(value.Array) == 0:
-		val = val
+		for i, c := range b {
+			field.Index(i).SetUint(uint64(c))
+		}
+	default:
+		return unknownType(typ)
+	}
+	return nil
+}
+
+// unknownType returns the fault for the unknown type element typ.
+func unknownType(typ string) Fault {
+	fault := FaultInvalidParams
+	fault.String += fmt.Sprintf(": unknown type <%s>", typ)
+	return fault
+}
+
+// typeMismatch returns the fault for XML-RPC value of type xmlType,
+// which cannot be stored in the Go type t.
+func typeMismatch(xmlType string, t reflect.Type) Fault {
+	fault := FaultInvalidParams
+	fault.String += fmt.Sprintf(": fields type mismatch: %s != %s", xmlType, t)
+	return fault
+}
+
+// isUnmarshaler reports whether t, after dereferencing the pointers,
+// implements Unmarshaler with the pointer receiver.
+func isUnmarshaler(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return reflect.PtrTo(t).Implements(unmarshalerType)
+}
+
+// unmarshaler2Field captures the whole value element and passes it to the
+// Unmarshaler implemented by field, allocating the pointers on the way.
+// <nil/> sets the pointer field to nil instead.
+func (d *Decoder) unmarshaler2Field(field reflect.Value) error {
+	data, typ, err := d.capture()
+	if err != nil {
+		return err
+	}
+	for field.Kind() == reflect.Ptr {
+		if typ == "nil" {
+			field.Set(reflect.Zero(field.Type()))
+			return nil
+		}
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+		field = field.Elem()
+	}
+	return field.Addr().Interface().(Unmarshaler).UnmarshalXMLRPC(data)
+}
 
+// capture returns the value element, which start element has just been
+// read, along with the name of its type element. The element is returned
+// as is, unless the document is converted from another charset, in which
+// case it's re-encoded.
+func (d *Decoder) capture() ([]byte, string, error) {
+	if d.converted {
+		return d.recode()
+	}
+
+	d.in.buf, d.in.on = d.in.buf[:0], true
+	typ, err := d.captureType(nil)
+	d.in.on = false
+	if err != nil {
+		return nil, "", err
+	}
+	if len(d.in.buf) == 0 {
+		// <value/>
+		return []byte("<value/>"), typ, nil
+	}
+	return append([]byte("<value>"), d.in.buf...), typ, nil
+}
+
+// recode re-encodes the value element for capture.
+func (d *Decoder) recode() ([]byte, string, error) {
+	var buf bytes.Buffer
+	enc := xml.NewEncoder(&buf)
+	enc.EncodeToken(xml.StartElement{Name: xml.Name{Local: "value"}})
+	typ, err := d.captureType(func(tok xml.Token) error {
+		if err := enc.EncodeToken(tok); err != nil {
+			return FaultDecode
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), typ, nil
+}
+
+// captureType reads the rest of the value element, passing the tokens
+// to fn, if it's not nil, and returns the name of its type element.
+func (d *Decoder) captureType(fn func(xml.Token) error) (string, error) {
+	var typ string
+	depth := d.depth
+	for d.depth >= depth {
+		tok, err := d.token()
+		if err != nil {
+			return "", err
+		}
+		if start, ok := tok.(xml.StartElement); ok && typ == "" {
+			typ = start.Name.Local
+		}
+		if fn != nil {
+			if err := fn(tok); err != nil {
+				return "", err
+			}
+		}
+	}
+	return typ, nil
+}
+
+// xml2Interface stores the value of type typ into the interface field
+// using the natural Go type for it: int (int64 for <i8>), float64,
+// string, bool, time.Time, []byte, []interface{}, map[string]interface{}
+// or nil.
+func (d *Decoder) xml2Interface(typ string, field reflect.Value) error {
+	var val interface{}
+	switch typ {
+	case "int", "i4":
+		val = int(0)
+	case "i8":
+		val = int64(0)
+	case "double":
+		val = float64(0)
+	case "string":
+		val = ""
+	case "boolean":
+		val = false
+	case "dateTime.iso8601":
+		val = time.Time{}
+	case "base64":
+		val = []byte(nil)
+	case "struct":
+		val = map[string]interface{}(nil)
+	case "array":
+		val = []interface{}(nil)
+	case "nil":
+		field.Set(reflect.Zero(field.Type()))
+		return nil
 	default:
-		// value field is default to string, see http://en.wikipedia.org/wiki/XML-RPC#Data_types
-		// also can be <nil/>
-		if value.Raw != "<nil/>" {
-			val = value.Raw
+		return unknownType(typ)
+	}
+
+	t := reflect.TypeOf(val)
+	if !t.AssignableTo(field.Type()) {
+		return typeMismatch(t.String(), field.Type())
+	}
+	v := reflect.New(t).Elem()
+	if err := typeDecoder(t).typed(d, typ, v); err != nil {
+		return err
+	}
+	field.Set(v)
+	return nil
+}
+
+// xml2Struct fills the struct field with the struct members, decoding
+// them with the decoders of the fields. Unknown members are skipped,
+// unless DisallowUnknownMembers is set.
+func (d *Decoder) xml2Struct(field reflect.Value, fields *structFields, decoders []*decoder) error {
+	return d.members(func(name string) (reflect.Value, *decoder, error) {
+		i, ok := fields.byMember(name, d.opts.SnakeCase)
+		if !ok {
+			if d.opts.DisallowUnknownMembers {
+				fault := FaultInvalidParams
+				fault.String += fmt.Sprintf(": unknown member %q of %s", name, field.Type())
+				return reflect.Value{}, nil, fault
+			}
+			return reflect.Value{}, nil, nil
 		}
+		fv := fieldByIndexAlloc(field, fields.list[i].index)
+		if !fv.IsValid() {
+			// promoted through the nil pointer to unexported struct
+			return reflect.Value{}, nil, FaultApplicationError
+		}
+		return fv, decoders[i], nil
+	})
+}
+
+// xml2Map fills the map field with the struct members, decoding them
+// with elemDec. Map keys must be of string kind.
+func (d *Decoder) xml2Map(field reflect.Value, elemDec *decoder) error {
+	t := field.Type()
+	if t.Key().Kind() != reflect.String {
+		fault := FaultInvalidParams
+		fault.String += fmt.Sprintf(": map key type must be string, got %s", t.Key())
+		return fault
+	}
+	if field.IsNil() {
+		field.Set(reflect.MakeMap(t))
 	}
 
-	if val != nil {
-		if reflect.TypeOf(val) != reflect.TypeOf(field.Interface()) {
+	var (
+		key  reflect.Value
+		elem reflect.Value
+	)
+	store := func() {
+		if elem.IsValid() {
+			field.SetMapIndex(key, elem)
+		}
+	}
+	err := d.members(func(name string) (reflect.Value, *decoder, error) {
+		store()
+		key = reflect.ValueOf(name).Convert(t.Key())
+		elem = reflect.New(t.Elem()).Elem()
+		return elem, elemDec, nil
+	})
+	if err != nil {
+		return err
+	}
+	store()
+	return nil
+}
+
+// members reads the struct members, decoding each value into the
+// field returned by lookup for the member name, along with its decoder.
+// The member is skipped, if lookup returns the invalid value. The first error is
+// returned after all the members are read, unless the document itself
+// can't be read.
+func (d *Decoder) members(lookup func(name string) (reflect.Value, *decoder, error)) error {
+	depth := d.depth
+	var err error
+	for d.depth >= depth {
+		tok, tokErr := d.next()
+		if tokErr != nil {
+			return tokErr
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			memberErr := d.member(start, lookup)
+			if fatal(memberErr) {
+				return memberErr
+			}
+			if err == nil {
+				err = memberErr
+			}
+		}
+	}
+	return err
+}
+
+// member reads the member, which start element has just been read.
+func (d *Decoder) member(start xml.StartElement, lookup func(name string) (reflect.Value, *decoder, error)) error {
+	depth := d.depth
+	if start.Name.Local != "member" {
+		return d.skip(depth)
+	}
+	if err := d.expect("name"); err != nil {
+		return err
+	}
+	name, err := d.text()
+	if err != nil {
+		return err
+	}
+	if err := d.expect("value"); err != nil {
+		return err
+	}
+	field, dec, err := lookup(string(name))
+	if err != nil || !field.IsValid() {
+		err = d.skipErr(err, d.depth)
+	} else {
+		err = d.value2Field(field, dec)
+	}
+	if fatal(err) {
+		return err
+	}
+	return d.skipErr(err, depth)
+}
+
+// fatal reports whether err means the document can't be read any further.
+func fatal(err error) bool {
+	return err == FaultDecode || err == FaultSystemError
+}
+
+// skipErr skips the element at depth and returns err, unless
+// skipping fails.
+func (d *Decoder) skipErr(err error, depth int) error {
+	if skipErr := d.skip(depth); skipErr != nil {
+		return skipErr
+	}
+	return err
+}
+
+// xml2Array fills the slice or array field with the array items, decoding
+// them with elemDec. The empty array, including the one without <data>,
+// results in the empty non-nil slice. The array field must have exactly
+// as many elements as the XML-RPC array. The first item error is
+// returned, annotated with the item index, after the whole array is read.
+func (d *Decoder) xml2Array(field reflect.Value, elemDec *decoder) error {
+	if field.Kind() == reflect.Slice {
+		if field.IsNil() {
+			field.Set(reflect.MakeSlice(field.Type(), 0, 0))
+		}
+		field.SetLen(0)
+	}
+
+	depth := d.depth
+	elemType := field.Type().Elem()
+	var err error
+	i := 0
+	for d.depth >= depth {
+		tok, tokErr := d.next()
+		if tokErr != nil {
+			return tokErr
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local == "data" {
+			continue
+		}
+		if start.Name.Local != "value" || field.Kind() == reflect.Array && i >= field.Len() {
+			// count the items not fitting into the array to report them
+			if start.Name.Local == "value" {
+				i++
+			}
+			if skipErr := d.skip(d.depth); skipErr != nil {
+				return skipErr
+			}
+			continue
+		}
+
+		if field.Kind() == reflect.Array {
+			field.Index(i).Set(reflect.Zero(elemType))
+		} else if i >= field.Cap() {
+			field.Set(reflect.Append(field, reflect.Zero(elemType)))
+		} else {
+			field.SetLen(i + 1)
+			field.Index(i).Set(reflect.Zero(elemType))
+		}
+		itemErr := d.value2Field(field.Index(i), elemDec)
+		if fatal(itemErr) {
+			return itemErr
+		}
+		if err == nil && itemErr != nil {
+			err = itemError(itemErr, i)
+		}
+		i++
+	}
+
+	if field.Kind() == reflect.Array && i != field.Len() {
+		fault := FaultInvalidParams
+		fault.String += fmt.Sprintf(": array length mismatch: %d != %d", i, field.Len())
+		return fault
+	}
+	return err
+}
+
+// itemError annotates the error decoding the array item with its index.
+func itemError(err error, i int) error {
+	if fault, ok := err.(Fault); ok {
+		fault.String += fmt.Sprintf(" (array item %d)", i)
+		return fault
+	}
+	return fmt.Errorf("array item %d: %v", i, err)
+}
+
+// xml2Int parses the <int>, <i4> or <i8> value into the integer field,
+// checking that it fits into the field type.
+func xml2Int(value string, field *reflect.Value) error {
+	value = strings.TrimSpace(value)
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			fault := FaultInvalidParams
+			fault.String += fmt.Sprintf(": invalid integer %q", value)
+			return fault
+		}
+		if field.OverflowInt(i) {
+			fault := FaultInvalidParams
+			fault.String += fmt.Sprintf(": integer %d overflows %s", i, field.Type())
+			return fault
+		}
+		field.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			fault := FaultInvalidParams
+			fault.String += fmt.Sprintf(": invalid unsigned integer %q", value)
+			return fault
+		}
+		if field.OverflowUint(u) {
 			fault := FaultInvalidParams
-			fault.String += fmt.Sprintf(": fields type mismatch: %s != %s",
-				reflect.TypeOf(val),
-				reflect.TypeOf(field.Interface()))
+			fault.String += fmt.Sprintf(": integer %d overflows %s", u, field.Type())
 			return fault
 		}
+		field.SetUint(u)
+	default:
+		return typeMismatch("int", field.Type())
+	}
+	return nil
+}
 
-		field.Set(reflect.ValueOf(val))
+// xml2Double parses the <double> value into the float field. Exponents
+// aren't allowed by the spec, but are accepted, as some implementations
+// write them anyway.
+func xml2Double(value string, field *reflect.Value) error {
+	if field.Kind() != reflect.Float32 && field.Kind() != reflect.Float64 {
+		return typeMismatch("float64", field.Type())
 	}
+	value = strings.TrimSpace(value)
+	f, err := strconv.ParseFloat(value, field.Type().Bits())
+	if err != nil {
+		fault := FaultInvalidParams
+		fault.String += fmt.Sprintf(": invalid double %q", value)
+		return fault
+	}
+	field.SetFloat(f)
+	return nil
+}
 
-	return err
+// int2Double parses the <int>, <i4> or <i8> value into the float field,
+// checking that the float type represents it exactly, e.g. float32 can't
+// hold the odd integers above 2^24.
+func int2Double(value string, field *reflect.Value) error {
+	value = strings.TrimSpace(value)
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		fault := FaultInvalidParams
+		fault.String += fmt.Sprintf(": invalid integer %q", value)
+		return fault
+	}
+	f := float64(i)
+	if field.Kind() == reflect.Float32 {
+		f = float64(float32(i))
+	}
+	// float64(i) is rounded up to 2^63 near the int64 limit,
+	// which int64 can't hold
+	if f >= 1<<63 || int64(f) != i {
+		fault := FaultInvalidParams
+		fault.String += fmt.Sprintf(": integer %d can't be represented exactly by %s", i, field.Type())
+		return fault
+	}
+	field.SetFloat(f)
+	return nil
+}
+
+// string2Field stores the <string> or untyped value into field,
+// converting it to the number or bool, if the coercion is enabled.
+// The time.Time field gets it parsed as dateTime.iso8601.
+func (d *Decoder) string2Field(text []byte, field reflect.Value) error {
+	if field.Type() == timeType {
+		t, err := xml2DateTime(string(text))
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(t))
+		return nil
+	}
+	if d.opts.Coerce && !reflect.PtrTo(field.Type()).Implements(textUnmarshalerType) {
+		switch field.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return xml2Int(string(text), &field)
+		case reflect.Float32, reflect.Float64:
+			return xml2Double(string(text), &field)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(strings.TrimSpace(string(text)))
+			if err != nil {
+				fault := FaultInvalidParams
+				fault.String += fmt.Sprintf(": invalid boolean %q", text)
+				return fault
+			}
+			field.SetBool(b)
+			return nil
+		}
+	}
+	return xml2String(text, &field)
+}
+
+// xml2String stores the <string> or untyped value into the string field,
+// or passes it to encoding.TextUnmarshaler implemented by the field. Its
+// error is returned as FaultInvalidParams, unless it's the Fault already.
+func xml2String(value []byte, field *reflect.Value) error {
+	if field.CanAddr() {
+		if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			err := u.UnmarshalText(value)
+			if _, ok := err.(Fault); err == nil || ok {
+				return err
+			}
+			fault := FaultInvalidParams
+			fault.String += fmt.Sprintf(": %v", err)
+			return fault
+		}
+	}
+	if field.Kind() != reflect.String {
+		return typeMismatch("string", field.Type())
+	}
+	field.SetString(string(value))
+	return nil
 }
 
 func xml2Bool(value string) bool {
@@ -188,23 +1330,38 @@ func xml2Bool(value string) bool {
 	return b
 }
 
-func xml2DateTime(value string) (time.Time, error) {
-	var (
-		year, month, day     int
-		hour, minute, second int
-	)
-	_, err := fmt.Sscanf(value, "%04d%02d%02dT%02d:%02d:%02d",
-		&year, &month, &day,
-		&hour, &minute, &second)
-	t := time.Date(year, time.Month(month), day, hour, minute, second, 0, time.Local)
-	return t, err
+// dateTimeLayouts are the dateTime.iso8601 variants sent by the real
+// servers. Each of them may be followed by the fractional seconds and
+// the zone designator.
+var dateTimeLayouts = []string{
+	"20060102T15:04:05",
+	"2006-01-02T15:04:05",
+	"20060102T150405",
 }
 
-func xml2Base64(value string) ([]byte, error) {
-	return base64.StdEncoding.DecodeString(value)
+// xml2DateTime parses the dateTime.iso8601 value. Values without the zone
+// designator ("Z", "+hh:mm" or "+hhmm") are interpreted in time.Local.
+func xml2DateTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range dateTimeLayouts {
+		for _, zone := range []string{"", "Z07:00", "Z0700"} {
+			if t, err := time.ParseInLocation(layout+zone, value, time.Local); err == nil {
+				return t, nil
+			}
+		}
+	}
+	fault := FaultInvalidParams
+	fault.String += fmt.Sprintf(": invalid dateTime.iso8601 %q", value)
+	return time.Time{}, fault
 }
 
-func uppercaseFirst(in string) (out string) {
-	r, n := utf8.DecodeRuneInString(in)
-	return string(unicode.ToUpper(r)) + in[n:]
+func xml2Base64(value []byte) ([]byte, error) {
+	b := make([]byte, base64.StdEncoding.DecodedLen(len(value)))
+	n, err := base64.StdEncoding.Decode(b, bytes.TrimSpace(value))
+	if err != nil {
+		fault := FaultInvalidParams
+		fault.String += ": invalid base64"
+		return nil, fault
+	}
+	return b[:n], nil
 }
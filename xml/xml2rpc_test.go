@@ -5,7 +5,12 @@
 package xml
 
 import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -154,3 +159,758 @@ Requiredattribute'user'notfound:
 		}
 	}
 }
+
+type StructIntsXml2Rpc struct {
+	I32 int32
+	I64 int64
+	U   uint
+	U8  uint8
+}
+
+func TestXML2RPCIntegers(t *testing.T) {
+	req := new(StructIntsXml2Rpc)
+	err := xml2RPC("<methodResponse><params><param><value><int>-32</int></value></param><param><value><i8>1099511627776</i8></value></param><param><value><i4>7</i4></value></param><param><value><int>255</int></value></param></params></methodResponse>", req)
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected_req := &StructIntsXml2Rpc{-32, 1 << 40, 7, 255}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+
+	for _, data := range []string{
+		"<methodResponse><params><param><value><int>1</int></value></param><param><value><int>1</int></value></param><param><value><int>1</int></value></param><param><value><int>256</int></value></param></params></methodResponse>",
+		"<methodResponse><params><param><value><int>1</int></value></param><param><value><int>1</int></value></param><param><value><int>-1</int></value></param><param><value><int>1</int></value></param></params></methodResponse>",
+		"<methodResponse><params><param><value><i8>4294967296</i8></value></param><param><value><int>1</int></value></param><param><value><int>1</int></value></param><param><value><int>1</int></value></param></params></methodResponse>",
+	} {
+		if err := xml2RPC(data, new(StructIntsXml2Rpc)); err == nil {
+			t.Errorf("expected out of range error for %s", data)
+		}
+	}
+}
+
+type StructMapXml2Rpc struct {
+	Ints    map[string]int
+	Structs map[string]SubStructXml2Rpc
+}
+
+func TestXML2RPCMap(t *testing.T) {
+	req := new(StructMapXml2Rpc)
+	err := xml2RPC("<methodResponse><params><param><value><struct><member><name>one</name><value><int>1</int></value></member><member><name>two</name><value><int>2</int></value></member></struct></value></param><param><value><struct><member><name>sub</name><value><struct><member><name>Foo</name><value><int>42</int></value></member><member><name>Bar</name><value><string>I'm Bar</string></value></member></struct></value></member></struct></value></param></params></methodResponse>", req)
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected_req := &StructMapXml2Rpc{
+		map[string]int{"one": 1, "two": 2},
+		map[string]SubStructXml2Rpc{"sub": {Foo: 42, Bar: "I'm Bar"}},
+	}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+}
+
+type StructInterfaceXml2Rpc struct {
+	Any   interface{}
+	Items []interface{}
+}
+
+func TestXML2RPCInterface(t *testing.T) {
+	req := new(StructInterfaceXml2Rpc)
+	err := xml2RPC("<methodResponse><params><param><value><struct><member><name>id</name><value><i4>7</i4></value></member><member><name>tags</name><value><array><data><value><string>a</string></value><value>b</value></data></array></value></member></struct></value></param><param><value><array><data><value><int>1</int></value><value><i8>1099511627776</i8></value><value><double>1.5</double></value><value><string>str</string></value><value><boolean>1</boolean></value><value><dateTime.iso8601>20120717T14:08:55</dateTime.iso8601></value><value><base64>eW91IGNhbid0IHJlYWQgdGhpcyE=</base64></value><value><nil/></value></data></array></value></param></params></methodResponse>", req)
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected_req := &StructInterfaceXml2Rpc{
+		map[string]interface{}{"id": 7, "tags": []interface{}{"a", "b"}},
+		[]interface{}{1, int64(1 << 40), 1.5, "str", true, time.Date(2012, time.July, 17, 14, 8, 55, 0, time.Local), []byte("you can't read this!"), nil},
+	}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+}
+
+type StructPtrXml2Rpc struct {
+	Int *int
+	Sub *SubStructXml2Rpc
+	Nil *SubStructXml2Rpc
+}
+
+func TestXML2RPCPointers(t *testing.T) {
+	req := &StructPtrXml2Rpc{Nil: &SubStructXml2Rpc{Foo: 1}}
+	err := xml2RPC("<methodResponse><params><param><value><int>42</int></value></param><param><value><struct><member><name>Foo</name><value><int>1</int></value></member><member><name>Bar</name><value><string>bar</string></value></member></struct></value></param><param><value><nil/></value></param></params></methodResponse>", req)
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	i := 42
+	expected_req := &StructPtrXml2Rpc{&i, &SubStructXml2Rpc{Foo: 1, Bar: "bar"}, nil}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+}
+
+type StructTagsXml2Rpc struct {
+	ID      int    `xmlrpc:"blog_id"`
+	Title   string `xmlrpc:"title,omitempty"`
+	Skipped string `xmlrpc:"-"`
+	private string
+}
+
+type StructTagsParamXml2Rpc struct {
+	Post    StructTagsXml2Rpc
+	private int
+}
+
+func TestXML2RPCTags(t *testing.T) {
+	req := new(StructTagsParamXml2Rpc)
+	err := xml2RPC("<methodResponse><params><param><value><struct><member><name>blog_id</name><value><int>1</int></value></member><member><name>title</name><value><string>Hello</string></value></member></struct></value></param></params></methodResponse>", req)
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected_req := &StructTagsParamXml2Rpc{Post: StructTagsXml2Rpc{ID: 1, Title: "Hello"}}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+}
+
+type StructNamesXml2Rpc struct {
+	BlogID  int
+	PerPage int
+	Title   string
+	Name    string `xml:"post_name"`
+}
+
+func TestXML2RPCMemberNames(t *testing.T) {
+	data := "<methodResponse><params><param><value><struct><member><name>blog_id</name><value><int>1</int></value></member><member><name>PERPAGE</name><value><int>20</int></value></member><member><name>title</name><value><string>Hello</string></value></member><member><name>post_name</name><value><string>hello</string></value></member><member><name>name</name><value><string>ignored</string></value></member></struct></value></param></params></methodResponse>"
+	req := new(struct{ Post StructNamesXml2Rpc })
+	d := NewDecoder(strings.NewReader(data))
+	d.SetOptions(DecoderOptions{SnakeCase: true})
+	if err := d.DecodeResponse(req); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected := StructNamesXml2Rpc{1, 20, "Hello", "hello"}
+	if !reflect.DeepEqual(req.Post, expected) {
+		t.Error("Expected", expected)
+		t.Error("Got", req.Post)
+	}
+
+	req = new(struct{ Post StructNamesXml2Rpc })
+	if err := xml2RPC(data, req); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected = StructNamesXml2Rpc{0, 20, "Hello", "hello"}
+	if !reflect.DeepEqual(req.Post, expected) {
+		t.Error("Expected", expected)
+		t.Error("Got", req.Post)
+	}
+
+	// The same type is decoded back from its encoding.
+	in := &struct{ Post StructTagsXml2Rpc }{StructTagsXml2Rpc{ID: 7, Title: "Round"}}
+	resp, err := rpcResponse2XML(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(struct{ Post StructTagsXml2Rpc })
+	if err := xml2RPC(resp, out); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Error("Expected", in)
+		t.Error("Got", out)
+	}
+}
+
+type AuthXml2Rpc struct {
+	User  string
+	Token string
+}
+
+type PageXml2Rpc struct {
+	Page    int
+	PerPage int `xmlrpc:"per_page"`
+}
+
+type StructEmbeddedXml2Rpc struct {
+	AuthXml2Rpc
+	*PageXml2Rpc
+	Name string
+}
+
+type StructEmbeddedParamXml2Rpc struct {
+	Req StructEmbeddedXml2Rpc
+}
+
+func TestXML2RPCEmbedded(t *testing.T) {
+	req := new(StructEmbeddedParamXml2Rpc)
+	err := xml2RPC("<methodResponse><params><param><value><struct><member><name>User</name><value><string>john</string></value></member><member><name>Token</name><value><string>secret</string></value></member><member><name>per_page</name><value><int>20</int></value></member><member><name>Name</name><value><string>posts</string></value></member></struct></value></param></params></methodResponse>", req)
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected_req := &StructEmbeddedParamXml2Rpc{StructEmbeddedXml2Rpc{
+		AuthXml2Rpc: AuthXml2Rpc{User: "john", Token: "secret"},
+		PageXml2Rpc: &PageXml2Rpc{PerPage: 20},
+		Name:        "posts",
+	}}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+}
+
+// Point is decoded from the "x,y" pair array.
+type Point struct {
+	X, Y int
+}
+
+func (p *Point) UnmarshalXMLRPC(data []byte) error {
+	var v struct {
+		Coords []int `xml:"array>data>value>int"`
+	}
+	if err := xml.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if len(v.Coords) != 2 {
+		return fmt.Errorf("expected 2 coordinates, got %d", len(v.Coords))
+	}
+	p.X, p.Y = v.Coords[0], v.Coords[1]
+	return nil
+}
+
+type StructUnmarshalerXml2Rpc struct {
+	Point Point
+	IP    net.IP
+	Ptr   *Point
+}
+
+func TestXML2RPCUnmarshaler(t *testing.T) {
+	req := new(StructUnmarshalerXml2Rpc)
+	err := xml2RPC("<methodResponse><params><param><value><array><data><value><int>1</int></value><value><int>2</int></value></data></array></value></param><param><value><string>10.0.0.1</string></value></param><param><value><array><data><value><int>3</int></value><value><int>4</int></value></data></array></value></param></params></methodResponse>", req)
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected_req := &StructUnmarshalerXml2Rpc{Point{1, 2}, net.ParseIP("10.0.0.1"), &Point{3, 4}}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+
+	err = xml2RPC("<methodResponse><params><param><value><string>10.0.0.256</string></value></param></params></methodResponse>", new(struct{ IP net.IP }))
+	expected_err := Fault{Code: -32602, String: "Invalid Method Parameters: invalid IP address: 10.0.0.256"}
+	if err != expected_err {
+		t.Error("Expected", expected_err)
+		t.Error("Got", err)
+	}
+}
+
+type StructDoublesXml2Rpc struct {
+	Exp    float64
+	Single float32
+	Any    interface{}
+}
+
+func TestXML2RPCDoubles(t *testing.T) {
+	req := new(StructDoublesXml2Rpc)
+	err := xml2RPC("<methodResponse><params><param><value><double>1e-09</double></value></param><param><value><double> 0.1 </double></value></param><param><value><double>-2.5E+3</double></value></param></params></methodResponse>", req)
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected_req := &StructDoublesXml2Rpc{1e-9, 0.1, -2500.0}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+
+	err = xml2RPC("<methodResponse><params><param><value><double>1</double></value></param><param><value><double>1e40</double></value></param><param><value><double>1</double></value></param></params></methodResponse>", new(StructDoublesXml2Rpc))
+	if err == nil {
+		t.Error("expected float32 overflow error, but got nil")
+	}
+}
+
+func TestXML2RPCDateTime(t *testing.T) {
+	expected := time.Date(2012, time.July, 17, 14, 8, 55, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"20120717T14:08:55", time.Date(2012, time.July, 17, 14, 8, 55, 0, time.Local)},
+		{"2012-07-17T14:08:55", time.Date(2012, time.July, 17, 14, 8, 55, 0, time.Local)},
+		{"20120717T140855Z", expected},
+		{"20120717T14:08:55Z", expected},
+		{"2012-07-17T14:08:55.250Z", expected.Add(250 * time.Millisecond)},
+		{"2012-07-17T17:08:55+03:00", expected},
+		{"20120717T09:08:55-0500", expected},
+	}
+	for _, tt := range tests {
+		req := new(struct{ Time time.Time })
+		err := xml2RPC("<methodResponse><params><param><value><dateTime.iso8601>"+tt.value+"</dateTime.iso8601></value></param></params></methodResponse>", req)
+		if err != nil {
+			t.Errorf("XML2RPC conversion of %s failed: %v", tt.value, err)
+			continue
+		}
+		if !req.Time.Equal(tt.expected) {
+			t.Errorf("XML2RPC conversion of %s failed: expected %v, got %v", tt.value, tt.expected, req.Time)
+		}
+	}
+
+	req := new(struct{ Time time.Time })
+	if err := xml2RPC("<methodResponse><params><param><value><dateTime.iso8601>yesterday</dateTime.iso8601></value></param></params></methodResponse>", req); err == nil {
+		t.Error("expected invalid dateTime error, but got nil")
+	}
+
+	// The untyped value is parsed as dateTime.iso8601 too,
+	// and the empty one leaves the fields untouched.
+	old := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	times := &struct {
+		Time  time.Time
+		Empty time.Time
+		Ptr   *time.Time
+	}{Empty: old}
+	if err := xml2RPC("<methodResponse><params><param><value>20120717T14:08:55Z</value></param><param><value/></param><param><value></value></param></params></methodResponse>", times); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if !times.Time.Equal(expected) || !times.Empty.Equal(old) || times.Ptr != nil {
+		t.Error("Expected", expected, old, nil)
+		t.Error("Got", times.Time, times.Empty, times.Ptr)
+	}
+}
+
+type StructEmptyXml2Rpc struct {
+	Str     string
+	Untyped string
+	Base64  []byte
+	Array   []int
+	NoData  []string
+	Struct  SubStructXml2Rpc
+	Map     map[string]int
+	Any     []interface{}
+	Int     int
+}
+
+func TestXML2RPCEmptyValues(t *testing.T) {
+	req := &StructEmptyXml2Rpc{Str: "old", Untyped: "old", Base64: []byte("old"), Array: []int{1}, Struct: SubStructXml2Rpc{Foo: 1}, Int: 42}
+	err := xml2RPC("<methodResponse><params><param><value><string></string></value></param><param><value></value></param><param><value><base64></base64></value></param><param><value><array><data/></array></value></param><param><value><array></array></value></param><param><value><struct/></value></param><param><value><struct></struct></value></param><param><value><array><data><value><string/></value><value/><value><array><data></data></array></value><value><struct></struct></value><value><base64/></value></data></array></value></param><param><value></value></param></params></methodResponse>", req)
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected_req := &StructEmptyXml2Rpc{"", "", []byte{}, []int{}, []string{}, SubStructXml2Rpc{Foo: 1}, map[string]int{}, []interface{}{"", "", []interface{}{}, map[string]interface{}{}, []byte{}}, 42}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+}
+
+type StructCoerceXml2Rpc struct {
+	Float   float64
+	Single  float32
+	Int     int64
+	Uint    uint8
+	Double  float64
+	Bool    bool
+	Untyped int
+	Str     string
+}
+
+func TestXML2RPCCoerce(t *testing.T) {
+	data := "<methodResponse><params><param><value><int>-32</int></value></param><param><value><i8>1099511627776</i8></value></param><param><value><i4>7</i4></value></param><param><value><string> 255 </string></value></param><param><value><string>1.5</string></value></param><param><value><string>true</string></value></param><param><value>42</value></param><param><value><string>str</string></value></param></params></methodResponse>"
+	req := new(StructCoerceXml2Rpc)
+	err := DecodeClientResponseWithOptions(strings.NewReader(data), req, DecoderOptions{Coerce: true})
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected_req := &StructCoerceXml2Rpc{-32, 1 << 40, 7, 255, 1.5, true, 42, "str"}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+
+	if err := DecodeClientResponse(strings.NewReader(data), new(StructCoerceXml2Rpc)); err == nil {
+		t.Error("expected type mismatch error without coercion, but got nil")
+	}
+
+	data = "<methodResponse><params><param><value><i8>-9007199254740992</i8></value></param><param><value><int>16777216</int></value></param></params></methodResponse>"
+	floats := new(struct {
+		Double float64
+		Single float32
+	})
+	if err := DecodeClientResponseWithOptions(strings.NewReader(data), floats, DecoderOptions{Coerce: true}); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if floats.Double != -(1<<53) || floats.Single != 1<<24 {
+		t.Error("Expected", -(1 << 53), 1<<24)
+		t.Error("Got", floats.Double, floats.Single)
+	}
+
+	for _, tt := range []struct {
+		data string
+		req  interface{}
+	}{
+		{"<methodResponse><params><param><value><string>256</string></value></param></params></methodResponse>", new(struct{ Uint uint8 })},
+		{"<methodResponse><params><param><value><string>yes</string></value></param></params></methodResponse>", new(struct{ Bool bool })},
+		{"<methodResponse><params><param><value><double>1.5</double></value></param></params></methodResponse>", new(struct{ Int int })},
+		{"<methodResponse><params><param><value><int>16777217</int></value></param></params></methodResponse>", new(struct{ Single float32 })},
+		{"<methodResponse><params><param><value><i8>9007199254740993</i8></value></param></params></methodResponse>", new(struct{ Double float64 })},
+		{"<methodResponse><params><param><value><i8>9223372036854775807</i8></value></param></params></methodResponse>", new(struct{ Double float64 })},
+	} {
+		if err := DecodeClientResponseWithOptions(strings.NewReader(tt.data), tt.req, DecoderOptions{Coerce: true}); err == nil {
+			t.Errorf("Decoding %s: expected error, but got nil", tt.data)
+		}
+	}
+}
+
+func TestXML2RPCUnknownMembers(t *testing.T) {
+	data := "<methodResponse><params><param><value><struct><member><name>Foo</name><value><int>42</int></value></member><member><name>extra</name><value><struct><member><name>Foo</name><value><string>nested</string></value></member></struct></value></member><member><name>Bar</name><value><string>I'm Bar</string></value></member><member><name>more</name><value><array><data><value><int>1</int></value></data></array></value></member></struct></value></param></params></methodResponse>"
+	req := new(struct{ Sub SubStructXml2Rpc })
+	if err := xml2RPC(data, req); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected := SubStructXml2Rpc{Foo: 42, Bar: "I'm Bar"}
+	if !reflect.DeepEqual(req.Sub, expected) {
+		t.Error("Expected", expected)
+		t.Error("Got", req.Sub)
+	}
+
+	d := NewDecoder(strings.NewReader(data))
+	d.SetOptions(DecoderOptions{DisallowUnknownMembers: true})
+	err := d.DecodeResponse(new(struct{ Sub SubStructXml2Rpc }))
+	expected_err := Fault{Code: -32602, String: "Invalid Method Parameters: unknown member \"extra\" of xml.SubStructXml2Rpc"}
+	if err != expected_err {
+		t.Error("Expected", expected_err)
+		t.Error("Got", err)
+	}
+}
+
+type StructArraysXml2Rpc struct {
+	Fixed   [3]int
+	Nested  [][]string
+	Ptrs    []*SubStructXml2Rpc
+	Structs []SubStructXml2Rpc
+}
+
+func TestXML2RPCArrays(t *testing.T) {
+	req := new(StructArraysXml2Rpc)
+	err := xml2RPC("<methodResponse><params><param><value><array><data><value><int>1</int></value><value><int>2</int></value><value><int>3</int></value></data></array></value></param><param><value><array><data><value><array><data><value>a</value><value>b</value></data></array></value><value><array><data/></array></value><value><array><data><value>c</value></data></array></value></data></array></value></param><param><value><array><data><value><struct><member><name>Foo</name><value><int>1</int></value></member></struct></value><value><nil/></value></data></array></value></param><param><value><array><data><value><struct><member><name>Bar</name><value>bar</value></member><member><name>Data</name><value><array><data><value><int>4</int></value></data></array></value></member></struct></value></data></array></value></param></params></methodResponse>", req)
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected_req := &StructArraysXml2Rpc{
+		[3]int{1, 2, 3},
+		[][]string{{"a", "b"}, {}, {"c"}},
+		[]*SubStructXml2Rpc{{Foo: 1}, nil},
+		[]SubStructXml2Rpc{{Bar: "bar", Data: []int{4}}},
+	}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+
+	tests := []struct {
+		data     string
+		expected string
+	}{
+		{"<value><int>1</int></value><value><int>2</int></value>", "Invalid Method Parameters: array length mismatch: 2 != 3"},
+		{"<value><int>1</int></value><value><int>2</int></value><value><int>3</int></value><value><int>4</int></value>", "Invalid Method Parameters: array length mismatch: 4 != 3"},
+		{"<value><int>1</int></value><value><string>two</string></value><value><int>x</int></value>", "Invalid Method Parameters: fields type mismatch: string != int (array item 1)"},
+	}
+	for _, tt := range tests {
+		err := xml2RPC("<methodResponse><params><param><value><array><data>"+tt.data+"</data></array></value></param></params></methodResponse>", new(struct{ Fixed [3]int }))
+		if err == nil || err.(Fault).String != tt.expected {
+			t.Error("Expected", tt.expected)
+			t.Error("Got", err)
+		}
+	}
+}
+
+type StructOptionalXml2Rpc struct {
+	Query   string
+	Limit   int    `xmlrpc:",default=10"`
+	Verbose *bool  `xmlrpc:",optional"`
+	Sort    string `xmlrpc:"sort,default=date"`
+}
+
+func TestXML2RPCOptionalParams(t *testing.T) {
+	req := new(StructOptionalXml2Rpc)
+	err := xml2RPC("<methodCall><methodName>Posts.Search</methodName><params><param><value>go</value></param></params></methodCall>", req)
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected_req := &StructOptionalXml2Rpc{"go", 10, nil, "date"}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+
+	req = new(StructOptionalXml2Rpc)
+	err = xml2RPC("<methodCall><methodName>Posts.Search</methodName><params><param><value>go</value></param><param><value><int>5</int></value></param><param><value><boolean>1</boolean></value></param></params></methodCall>", req)
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	verbose := true
+	expected_req = &StructOptionalXml2Rpc{"go", 5, &verbose, "date"}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+
+	tests := []struct {
+		params   string
+		expected string
+	}{
+		{"", "Wrong Arguments Number: expected 1 to 4 params, got 0"},
+		{"<param><value>go</value></param><param><value><int>5</int></value></param><param><value><boolean>1</boolean></value></param><param><value>title</value></param><param><value>extra</value></param>", "Wrong Arguments Number: expected 1 to 4 params, got 5"},
+	}
+	for _, tt := range tests {
+		err := xml2RPC("<methodCall><methodName>Posts.Search</methodName><params>"+tt.params+"</params></methodCall>", new(StructOptionalXml2Rpc))
+		if err == nil || err.(Fault).String != tt.expected {
+			t.Error("Expected", tt.expected)
+			t.Error("Got", err)
+		}
+	}
+
+	// The invalid default is reported, even if the param is sent.
+	err = xml2RPC("<methodCall><methodName>Posts.Search</methodName><params><param><value><int>5</int></value></param></params></methodCall>", new(struct {
+		Limit int `xmlrpc:",default=ten"`
+	}))
+	expected_err := Fault{Code: -32603, String: "Internal Server Error: invalid default \"ten\" of Limit: Invalid Method Parameters: invalid integer \"ten\""}
+	if err != expected_err {
+		t.Error("Expected", expected_err)
+		t.Error("Got", err)
+	}
+
+	// Each request gets its own copy of the default.
+	type ptrDefault struct {
+		Limit *int `xmlrpc:",default=10"`
+	}
+	first, second := new(ptrDefault), new(ptrDefault)
+	for _, req := range []*ptrDefault{first, second} {
+		if err := xml2RPC("<methodCall><methodName>Posts.Search</methodName><params></params></methodCall>", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	*first.Limit = 5
+	if *second.Limit != 10 {
+		t.Error("Expected", 10)
+		t.Error("Got", *second.Limit)
+	}
+}
+
+type StructRestXml2Rpc struct {
+	Level string
+	Args  []interface{} `xmlrpc:",rest"`
+}
+
+func TestXML2RPCRestParams(t *testing.T) {
+	req := new(StructRestXml2Rpc)
+	err := xml2RPC("<methodCall><methodName>log.write</methodName><params><param><value>info</value></param><param><value>started</value></param><param><value><int>2</int></value></param><param><value><boolean>1</boolean></value></param></params></methodCall>", req)
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	expected_req := &StructRestXml2Rpc{"info", []interface{}{"started", 2, true}}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+
+	req = &StructRestXml2Rpc{Args: []interface{}{"old"}}
+	if err := xml2RPC("<methodCall><methodName>log.write</methodName><params><param><value>info</value></param></params></methodCall>", req); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if req.Args != nil {
+		t.Error("Expected no rest params, got", req.Args)
+	}
+
+	err = xml2RPC("<methodCall><methodName>log.write</methodName><params></params></methodCall>", new(StructRestXml2Rpc))
+	if err == nil || err.(Fault).String != "Wrong Arguments Number: expected at least 1 params, got 0" {
+		t.Error("Expected", "Wrong Arguments Number: expected at least 1 params, got 0")
+		t.Error("Got", err)
+	}
+
+	ints := new(struct {
+		Ints []int `xmlrpc:",rest"`
+	})
+	if err := xml2RPC("<methodCall><methodName>sum</methodName><params><param><value><int>1</int></value></param><param><value>2</value></param></params></methodCall>", ints); err == nil {
+		t.Error("expected type mismatch error, but got nil")
+	}
+}
+
+type pageXml2Rpc struct {
+	Page int
+}
+
+type StructEmbeddedParamsXml2Rpc struct {
+	*pageXml2Rpc
+	Q string
+}
+
+func TestXML2RPCUnsettableParam(t *testing.T) {
+	// Page is promoted through the nil unexported pointer, which
+	// the decoder can't allocate.
+	err := xml2RPC("<methodCall><methodName>search</methodName><params><param><value><int>2</int></value></param><param><value>query</value></param></params></methodCall>", new(StructEmbeddedParamsXml2Rpc))
+	if err != FaultApplicationError {
+		t.Error("Expected", FaultApplicationError)
+		t.Error("Got", err)
+	}
+}
+
+// oneByteReader returns a single byte per Read call, to make sure
+// the decoder doesn't depend on the document being read at once.
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (r oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return r.r.Read(p[:1])
+}
+
+func TestDecoder(t *testing.T) {
+	data := "<?xml version=\"1.0\"?>\n<methodCall>\n  <methodName>Some.Method</methodName>\n  <params>\n    <param><value><i4>123</i4></value></param>\n    <param><value><double>3.145926</double></value></param>\n    <param><value>Hello, World!</value></param>\n    <param><value><boolean>0</boolean></value></param>\n    <param><value><struct>\n      <member><name>Foo</name><value><int>42</int></value></member>\n      <member><name>Bar</name><value><string>I'm Bar</string></value></member>\n      <member><name>Data</name><value><array><data>\n        <value><int>1</int></value><value><int>2</int></value><value><int>3</int></value>\n      </data></array></value></member>\n    </struct></value></param>\n    <param><value><dateTime.iso8601>20120717T14:08:55</dateTime.iso8601></value></param>\n    <param><value><base64>\neW91IGNhbid0\nIHJlYWQgdGhpcyE=\n</base64></value></param>\n  </params>\n</methodCall>"
+	req := new(StructXml2Rpc)
+	method, err := NewDecoder(oneByteReader{strings.NewReader(data)}).DecodeRequest(req)
+	if err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	if method != "Some.Method" {
+		t.Error("Expected", "Some.Method")
+		t.Error("Got", method)
+	}
+	expected_req := &StructXml2Rpc{123, 3.145926, "Hello, World!", false, SubStructXml2Rpc{42, "I'm Bar", []int{1, 2, 3}}, time.Date(2012, time.July, 17, 14, 8, 55, 0, time.Local), []byte("you can't read this!")}
+	if !reflect.DeepEqual(req, expected_req) {
+		t.Error("XML2RPC conversion failed")
+		t.Error("Expected", expected_req)
+		t.Error("Got", req)
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	tooMany := FaultWrongArgumentsNumber
+	tooMany.String += ": expected 1 params, got 2"
+	tooFew := FaultWrongArgumentsNumber
+	tooFew.String += ": expected 1 params, got 0"
+	tests := []struct {
+		data     string
+		expected error
+	}{
+		{"", FaultDecode},
+		{"<methodResponse><params><param><value><int>1</int></value></param>", FaultDecode},
+		{"<methodResponse><params><param><value><int>1</value></param></params></methodResponse>", FaultDecode},
+		{"<methodCall><methodName>Some.Method</methodName></methodCall>", FaultDecode},
+		{"<methodResponse><params><param><value><int>1</int></value></param><param><value><int>2</int></value></param></params></methodResponse>", tooMany},
+		{"<methodResponse><params></params></methodResponse>", tooFew},
+	}
+	for _, tt := range tests {
+		err := NewDecoder(strings.NewReader(tt.data)).DecodeResponse(new(struct{ Int int }))
+		if err != tt.expected {
+			t.Errorf("Decoding %q: expected %v, got %v", tt.data, tt.expected, err)
+		}
+	}
+}
+
+func TestDecoderMaxDepth(t *testing.T) {
+	nested := func(n int) string {
+		return "<methodResponse><params><param>" + strings.Repeat("<value><array><data>", n) + strings.Repeat("</data></array></value>", n) + "</param></params></methodResponse>"
+	}
+
+	err := NewDecoder(strings.NewReader(nested(1000000))).DecodeResponse(new(struct{ Any interface{} }))
+	if err != FaultDecode {
+		t.Error("Expected", FaultDecode)
+		t.Error("Got", err)
+	}
+
+	d := NewDecoder(strings.NewReader(nested(3)))
+	d.SetOptions(DecoderOptions{MaxDepth: 2})
+	if err := d.DecodeResponse(new(struct{ Any interface{} })); err != FaultDecode {
+		t.Error("Expected", FaultDecode)
+		t.Error("Got", err)
+	}
+	d = NewDecoder(strings.NewReader(nested(3)))
+	d.SetOptions(DecoderOptions{MaxDepth: 3})
+	if err := d.DecodeResponse(new(struct{ Any interface{} })); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+
+	// Whatever the encoder writes with the default limit is decoded.
+	var v interface{} = 1
+	for i := 1; i < defaultMaxDepth; i++ {
+		v = []interface{}{v}
+	}
+	xml, err := rpcResponse2XML(&struct{ Any interface{} }{v})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xml2RPC(xml, new(struct{ Any interface{} })); err != nil {
+		t.Error("XML2RPC conversion failed", err)
+	}
+	v = []interface{}{v}
+	if _, err := rpcResponse2XML(&struct{ Any interface{} }{v}); err == nil {
+		t.Error("expected maximum depth error, but got nil")
+	}
+}
+
+func TestDecoderFault(t *testing.T) {
+	data := "<methodResponse><fault><value><struct><member><name>faultCode</name><value><int>4</int></value></member><member><name>faultString</name><value>Too many parameters.</value></member></struct></value></fault></methodResponse>"
+	err := NewDecoder(strings.NewReader(data)).DecodeResponse(new(struct{ Int int }))
+	expected := Fault{Code: 4, String: "Too many parameters."}
+	if err != expected {
+		t.Error("Expected", expected)
+		t.Error("Got", err)
+	}
+}
+
+type NodeXml2Rpc struct {
+	Name     string
+	Next     *NodeXml2Rpc
+	Children []NodeXml2Rpc
+}
+
+func TestXML2RPCRecursive(t *testing.T) {
+	data := "<methodResponse><params><param><value><struct><member><name>Name</name><value>a</value></member><member><name>Next</name><value><struct><member><name>Name</name><value>b</value></member><member><name>Next</name><value><nil/></value></member></struct></value></member><member><name>Children</name><value><array><data><value><struct><member><name>Name</name><value>c</value></member></struct></value></data></array></value></member></struct></value></param></params></methodResponse>"
+	expected := &struct{ Node NodeXml2Rpc }{NodeXml2Rpc{Name: "a", Next: &NodeXml2Rpc{Name: "b"}, Children: []NodeXml2Rpc{{Name: "c"}}}}
+
+	// The decoders for the type are compiled concurrently on the first use.
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			res := new(struct{ Node NodeXml2Rpc })
+			err := xml2RPC(data, res)
+			if err == nil && !reflect.DeepEqual(res, expected) {
+				err = fmt.Errorf("expected %+v, got %+v", expected, res)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func BenchmarkXML2RPC(b *testing.B) {
+	data := "<methodCall><methodName>Some.Method</methodName><params><param><value><i4>123</i4></value></param><param><value><double>3.145926</double></value></param><param><value><string>Hello, World!</string></value></param><param><value><boolean>0</boolean></value></param><param><value><struct><member><name>Foo</name><value><int>42</int></value></member><member><name>Bar</name><value><string>I'm Bar</string></value></member><member><name>Data</name><value><array><data><value><int>1</int></value><value><int>2</int></value><value><int>3</int></value></data></array></value></member></struct></value></param><param><value><dateTime.iso8601>20120717T14:08:55</dateTime.iso8601></value></param><param><value><base64>eW91IGNhbid0IHJlYWQgdGhpcyE=</base64></value></param></params></methodCall>"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := xml2RPC(data, new(StructXml2Rpc)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/gorilla/rpc"
@@ -127,6 +128,35 @@ func execute(t *testing.T, s *rpc.Server, method string, req, res interface{}) e
 	return DecodeClientResponse(w.Body, res)
 }
 
+func TestServicesCharset(t *testing.T) {
+	codec := NewCodec()
+	codec.SetEncoderOptions(EncoderOptions{Charset: "windows-1252"})
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "text/xml")
+	s.RegisterService(new(Service2), "")
+
+	body := "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?><methodCall><methodName>Service2.GetGreeting</methodName><params><param><value>J\xf6rg</value></param><param><value><int>33</int></value></param><param><value><boolean>1</boolean></value></param></params></methodCall>"
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "text/xml")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if ct := w.Header().Get("Content-Type"); ct != "text/xml; charset=windows-1252" {
+		t.Errorf("Wrong Content-Type: %v.", ct)
+	}
+	if !strings.HasPrefix(w.Body.String(), "<?xml version=\"1.0\" encoding=\"windows-1252\"?>") || !strings.Contains(w.Body.String(), "J\xf6rg") {
+		t.Errorf("Wrong response encoding: %q.", w.Body.String())
+	}
+
+	var res Service2Response
+	if err := DecodeClientResponse(w.Body, &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if res.Message != "Hello, user Jörg. You're 33 years old :-P And you has permit." {
+		t.Errorf("Wrong response: %v.", res.Message)
+	}
+}
+
 func TestRPC2XMLConverter(t *testing.T) {
 	req := &Service1Request{4, 2}
 	xml, err := rpcRequest2XML("Some.Method", req)